@@ -0,0 +1,141 @@
+package utilities
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrLockNotAcquired is returned by the try variants when another session holds the lock
+var ErrLockNotAcquired = errors.New("advisory lock not acquired")
+
+// advisoryUnlockTimeout bound the unlock, it runs after ctx may already be done
+const advisoryUnlockTimeout = 5 * time.Second
+
+// AdvisoryLockKey hash name into the bigint key space of postgres advisory locks
+func AdvisoryLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+/*
+WithAdvisoryLock run fn while holding the session level postgres advisory lock of key, waiting for it when
+another session holds it. The lock lives on a dedicated connection of the pool and is released when fn returns
+or as soon as ctx is done, fn must stop on ctx.Done since it no longer has the lock then.
+
+	err := WithAdvisoryLock(ctx, db, "job:daily-report", func(ctx context.Context) error {
+		return runDailyReport(ctx)
+	})
+*/
+func WithAdvisoryLock(ctx context.Context, db *gorm.DB, key string, fn func(ctx context.Context) error) error {
+	return withSessionLock(ctx, db, key, false, fn)
+}
+
+// TryWithAdvisoryLock is WithAdvisoryLock returning ErrLockNotAcquired instead of waiting
+func TryWithAdvisoryLock(ctx context.Context, db *gorm.DB, key string, fn func(ctx context.Context) error) error {
+	return withSessionLock(ctx, db, key, true, fn)
+}
+
+/*
+WithAdvisoryXactLock run fn in a transaction holding the transaction level advisory lock of key,
+postgres releases it on commit or rollback. A done ctx rolls the transaction back, which releases the lock.
+*/
+func WithAdvisoryXactLock(ctx context.Context, db *gorm.DB, key string, fn func(tx *gorm.DB) error) error {
+	return withXactLock(ctx, db, key, false, fn)
+}
+
+// TryWithAdvisoryXactLock is WithAdvisoryXactLock returning ErrLockNotAcquired instead of waiting
+func TryWithAdvisoryXactLock(ctx context.Context, db *gorm.DB, key string, fn func(tx *gorm.DB) error) error {
+	return withXactLock(ctx, db, key, true, fn)
+}
+
+func withSessionLock(ctx context.Context, db *gorm.DB, key string, try bool, fn func(ctx context.Context) error) error {
+	if db.Dialector.Name() != Postgresql {
+		return fmt.Errorf("advisory locks are only supported on postgres")
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get advisory lock connection: %w", err)
+	}
+	defer conn.Close()
+
+	id := AdvisoryLockKey(key)
+	if try {
+		var acquired bool
+		if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", id).Scan(&acquired); err != nil {
+			return fmt.Errorf("failed to acquire advisory lock %s: %w", key, err)
+		}
+		if !acquired {
+			return ErrLockNotAcquired
+		}
+	} else if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", id); err != nil {
+		return fmt.Errorf("failed to acquire advisory lock %s: %w", key, err)
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { unlockSession(conn, id) })
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			release()
+		case <-done:
+		}
+	}()
+
+	defer release()
+	return fn(ctx)
+}
+
+// unlockSession release the lock, a connection which cannot unlock is thrown away so its session ends
+func unlockSession(conn *sql.Conn, id int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), advisoryUnlockTimeout)
+	defer cancel()
+
+	var released bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", id).Scan(&released); err != nil || !released {
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+}
+
+func withXactLock(ctx context.Context, db *gorm.DB, key string, try bool, fn func(tx *gorm.DB) error) error {
+	if db.Dialector.Name() != Postgresql {
+		return fmt.Errorf("advisory locks are only supported on postgres")
+	}
+
+	id := AdvisoryLockKey(key)
+	return db.WithContext(ForcePrimary(ctx)).Transaction(func(tx *gorm.DB) error {
+		if !try {
+			if err := tx.Exec("SELECT pg_advisory_xact_lock(?)", id).Error; err != nil {
+				return fmt.Errorf("failed to acquire advisory lock %s: %w", key, err)
+			}
+			return fn(tx)
+		}
+
+		var acquired bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", id).Scan(&acquired).Error; err != nil {
+			return fmt.Errorf("failed to acquire advisory lock %s: %w", key, err)
+		}
+		if !acquired {
+			return ErrLockNotAcquired
+		}
+		return fn(tx)
+	})
+}
@@ -0,0 +1,420 @@
+package utilities
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+)
+
+const (
+	auditBeforeKey = "utilities:audit_before"
+	auditTxKey     = "utilities:audit_transaction"
+	//primary keys per audit reload, keeps the IN list under the bind parameter limit
+	auditLoadChunk = 1000
+)
+
+type auditActorKey struct{}
+
+// WithAuditActor set the actor recorded by the audit plugin for changes made with ctx
+func WithAuditActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, auditActorKey{}, actor)
+}
+
+func AuditActor(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	actor, _ := ctx.Value(auditActorKey{}).(string)
+	return actor
+}
+
+// Auditable let a model opt in or out of the audit trail regardless of AuditConfig.AuditAll
+type Auditable interface {
+	AuditEnabled() bool
+}
+
+// AuditLog is a row of the audit table
+type AuditLog struct {
+	ID        uint64 `gorm:"primaryKey"`
+	Table     string `gorm:"column:table_name;size:128;index"`
+	RecordID  string `gorm:"size:255;index"`
+	Action    string `gorm:"size:16"`
+	Actor     string `gorm:"size:255"`
+	Changes   string `gorm:"type:text"`
+	CreatedAt time.Time
+}
+
+// AuditChange is the old and new value of a column, Old is nil on create and New is nil on delete
+type AuditChange struct {
+	Old any `json:"old,omitempty"`
+	New any `json:"new,omitempty"`
+}
+
+type AuditConfig struct {
+	//audit table, default audit_logs
+	Table string
+	//audit every model which does not implement Auditable, otherwise only models whose AuditEnabled returns true
+	AuditAll bool
+}
+
+/*
+NewAuditPlugin record creates, updates and deletes into the audit table, in the same transaction as the change.
+Audited statements get their own transaction when they do not run in one, mysql pools skip the GORM default
+transaction.
+
+Fields tagged audit:"-" are left out of the diff, fields tagged audit:"redact" and encrypted columns are recorded
+without their values.
+
+	type Customer struct {
+		ID    uint
+		Name  string
+		NIK   string `audit:"redact"`
+		Notes string `audit:"-"`
+	}
+
+	func (Customer) AuditEnabled() bool { return true }
+
+	dbm := NewDBManager(cfg, WithGormPlugins(NewAuditPlugin(AuditConfig{})))
+	db, _ := dbm.DB(WithAuditActor(ctx, userID))
+*/
+func NewAuditPlugin(cfg AuditConfig) gorm.Plugin {
+	if cfg.Table == "" {
+		cfg.Table = "audit_logs"
+	}
+	return &auditPlugin{cfg: cfg}
+}
+
+type auditPlugin struct {
+	cfg AuditConfig
+}
+
+func (p *auditPlugin) Name() string {
+	return "utilities:audit"
+}
+
+func (p *auditPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().After("gorm:begin_transaction").Before("gorm:create").
+			Register("utilities:audit_begin_create", p.begin),
+		cb.Create().After("gorm:create").Before("gorm:commit_or_rollback_transaction").
+			Register("utilities:audit_create", p.afterCreate),
+		cb.Create().After("gorm:commit_or_rollback_transaction").Register("utilities:audit_commit_create", p.commit),
+
+		cb.Update().After("gorm:begin_transaction").Before("gorm:update").
+			Register("utilities:audit_begin_update", p.begin),
+		cb.Update().After("utilities:audit_begin_update").Before("gorm:update").
+			Register("utilities:audit_before_update", p.capture),
+		cb.Update().After("gorm:update").Before("gorm:commit_or_rollback_transaction").
+			Register("utilities:audit_update", p.afterUpdate),
+		cb.Update().After("gorm:commit_or_rollback_transaction").Register("utilities:audit_commit_update", p.commit),
+
+		cb.Delete().After("gorm:begin_transaction").Before("gorm:delete").
+			Register("utilities:audit_begin_delete", p.begin),
+		cb.Delete().After("utilities:audit_begin_delete").Before("gorm:delete").
+			Register("utilities:audit_before_delete", p.capture),
+		cb.Delete().After("gorm:delete").Before("gorm:commit_or_rollback_transaction").
+			Register("utilities:audit_delete", p.afterDelete),
+		cb.Delete().After("gorm:commit_or_rollback_transaction").Register("utilities:audit_commit_delete", p.commit),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// begin open a transaction for an audited statement when GORM skips its default one, like gorm:begin_transaction
+func (p *auditPlugin) begin(db *gorm.DB) {
+	if !db.Config.SkipDefaultTransaction || db.Error != nil || !p.enabled(db) {
+		return
+	}
+
+	tx := db.Begin()
+	switch {
+	case tx.Error == nil:
+		db.Statement.ConnPool = tx.Statement.ConnPool
+		db.InstanceSet(auditTxKey, true)
+	case errors.Is(tx.Error, gorm.ErrInvalidTransaction):
+		//already in a transaction
+	default:
+		db.AddError(tx.Error)
+	}
+}
+
+func (p *auditPlugin) commit(db *gorm.DB) {
+	if _, ok := db.InstanceGet(auditTxKey); !ok {
+		return
+	}
+	if db.Error != nil {
+		db.Rollback()
+	} else {
+		db.Commit()
+	}
+	db.Statement.ConnPool = db.ConnPool
+}
+
+func (p *auditPlugin) enabled(db *gorm.DB) bool {
+	stmt := db.Statement
+	if db.DryRun || stmt.Schema == nil || stmt.Schema.PrioritizedPrimaryField == nil {
+		return false
+	}
+	if stmt.Schema.ModelType == reflect.TypeOf(AuditLog{}) {
+		return false
+	}
+
+	if a, ok := reflect.New(stmt.Schema.ModelType).Interface().(Auditable); ok {
+		return a.AuditEnabled()
+	}
+	return p.cfg.AuditAll
+}
+
+func (p *auditPlugin) afterCreate(db *gorm.DB) {
+	if db.Error != nil || !p.enabled(db) {
+		return
+	}
+
+	stmt := db.Statement
+	var logs []AuditLog
+	eachRecord(stmt.ReflectValue, func(rv reflect.Value) {
+		changes := map[string]AuditChange{}
+		for _, f := range stmt.Schema.Fields {
+			if f.DBName == "" || f.Tag.Get("audit") == "-" {
+				continue
+			}
+			v, _ := f.ValueOf(stmt.Context, rv)
+			changes[f.DBName] = AuditChange{New: auditValue(f, v)}
+		}
+
+		pk, _ := stmt.Schema.PrioritizedPrimaryField.ValueOf(stmt.Context, rv)
+		logs = append(logs, p.newLog(db, AuditCreate, fmt.Sprint(pk), changes))
+	})
+
+	p.write(db, logs)
+}
+
+// capture load the rows about to be updated or deleted
+func (p *auditPlugin) capture(db *gorm.DB) {
+	if db.Error != nil || !p.enabled(db) {
+		return
+	}
+
+	where, ids := p.conditions(db)
+	rows, err := p.loadByIDs(db, where, ids)
+	if err != nil {
+		db.AddError(fmt.Errorf("failed to load audit rows: %w", err))
+		return
+	}
+	db.Statement.Settings.Store(auditBeforeKey, rows)
+}
+
+func (p *auditPlugin) afterUpdate(db *gorm.DB) {
+	before, ok := p.captured(db)
+	if !ok || len(before) == 0 {
+		return
+	}
+
+	pk := db.Statement.Schema.PrioritizedPrimaryField.DBName
+	ids := make([]any, 0, len(before))
+	for _, row := range before {
+		ids = append(ids, row[pk])
+	}
+
+	after, err := p.loadByIDs(db, nil, ids)
+	if err != nil {
+		db.AddError(fmt.Errorf("failed to load audit rows: %w", err))
+		return
+	}
+
+	afterByID := map[string]map[string]any{}
+	for _, row := range after {
+		afterByID[fmt.Sprint(row[pk])] = row
+	}
+
+	var logs []AuditLog
+	for _, old := range before {
+		id := fmt.Sprint(old[pk])
+		changes := p.diff(db, old, afterByID[id])
+		if len(changes) > 0 {
+			logs = append(logs, p.newLog(db, AuditUpdate, id, changes))
+		}
+	}
+
+	p.write(db, logs)
+}
+
+func (p *auditPlugin) afterDelete(db *gorm.DB) {
+	before, ok := p.captured(db)
+	if !ok || len(before) == 0 {
+		return
+	}
+
+	pk := db.Statement.Schema.PrioritizedPrimaryField.DBName
+	var logs []AuditLog
+	for _, old := range before {
+		logs = append(logs, p.newLog(db, AuditDelete, fmt.Sprint(old[pk]), p.diff(db, old, nil)))
+	}
+
+	p.write(db, logs)
+}
+
+func (p *auditPlugin) captured(db *gorm.DB) ([]map[string]any, bool) {
+	if db.Error != nil {
+		return nil, false
+	}
+	v, ok := db.Statement.Settings.Load(auditBeforeKey)
+	if !ok {
+		return nil, false
+	}
+	db.Statement.Settings.Delete(auditBeforeKey)
+	return v.([]map[string]any), true
+}
+
+// conditions rebuild the where clause GORM will use and the primary keys of the model, which GORM only adds later on
+func (p *auditPlugin) conditions(db *gorm.DB) ([]clause.Expression, []any) {
+	stmt := db.Statement
+	var conds []clause.Expression
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok {
+			conds = append(conds, where.Exprs...)
+		}
+	}
+
+	pk := stmt.Schema.PrioritizedPrimaryField
+	var ids []any
+	eachRecord(stmt.ReflectValue, func(rv reflect.Value) {
+		if v, zero := pk.ValueOf(stmt.Context, rv); !zero {
+			ids = append(ids, v)
+		}
+	})
+	return conds, ids
+}
+
+// loadByIDs load the rows matching conds, restricted to the primary keys ids in chunks when there are any
+func (p *auditPlugin) loadByIDs(db *gorm.DB, conds []clause.Expression, ids []any) ([]map[string]any, error) {
+	if len(ids) == 0 {
+		return p.load(db, conds)
+	}
+
+	pk := db.Statement.Schema.PrioritizedPrimaryField.DBName
+	var rows []map[string]any
+	for start := 0; start < len(ids); start += auditLoadChunk {
+		end := min(start+auditLoadChunk, len(ids))
+		chunk := append(conds[:len(conds):len(conds)], clause.IN{Column: clause.Column{Name: pk}, Values: ids[start:end]})
+		loaded, err := p.load(db, chunk)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, loaded...)
+	}
+	return rows, nil
+}
+
+func (p *auditPlugin) load(db *gorm.DB, conds []clause.Expression) ([]map[string]any, error) {
+	if len(conds) == 0 && !db.AllowGlobalUpdate {
+		return nil, nil
+	}
+
+	//read from the primary, a replica may lag behind the change being audited
+	var rows []map[string]any
+	tx := db.Session(&gorm.Session{NewDB: true, Context: ForcePrimary(db.Statement.Context)}).Table(db.Statement.Table)
+	if db.Statement.TableExpr != nil {
+		//db.Table("tenant.users") leaves only "users" in Table
+		tx.Statement.TableExpr = db.Statement.TableExpr
+	}
+	if len(conds) > 0 {
+		tx = tx.Clauses(clause.Where{Exprs: conds})
+	}
+	err := tx.Find(&rows).Error
+	return rows, err
+}
+
+func (p *auditPlugin) diff(db *gorm.DB, old, new map[string]any) map[string]AuditChange {
+	changes := map[string]AuditChange{}
+	for _, f := range db.Statement.Schema.Fields {
+		if f.DBName == "" || f.Tag.Get("audit") == "-" {
+			continue
+		}
+
+		oldValue := normalizeAuditValue(old[f.DBName])
+		if new == nil {
+			changes[f.DBName] = AuditChange{Old: auditValue(f, oldValue)}
+			continue
+		}
+
+		newValue := normalizeAuditValue(new[f.DBName])
+		if !reflect.DeepEqual(oldValue, newValue) {
+			changes[f.DBName] = AuditChange{Old: auditValue(f, oldValue), New: auditValue(f, newValue)}
+		}
+	}
+	return changes
+}
+
+func (p *auditPlugin) newLog(db *gorm.DB, action, id string, changes map[string]AuditChange) AuditLog {
+	data, _ := json.Marshal(changes)
+	return AuditLog{
+		Table:     db.Statement.Table,
+		RecordID:  id,
+		Action:    action,
+		Actor:     AuditActor(db.Statement.Context),
+		Changes:   string(data),
+		CreatedAt: time.Now(),
+	}
+}
+
+func (p *auditPlugin) write(db *gorm.DB, logs []AuditLog) {
+	if len(logs) == 0 {
+		return
+	}
+
+	err := db.Session(&gorm.Session{NewDB: true}).Table(TenantTable(db, p.cfg.Table)).Create(&logs).Error
+	if err != nil {
+		db.AddError(fmt.Errorf("failed to write audit logs: %w", err))
+	}
+}
+
+var encryptedColumnType = reflect.TypeOf((*encryptedColumn)(nil)).Elem()
+
+func auditValue(f *schema.Field, v any) any {
+	redact := f.Tag.Get("audit") == "redact" || reflect.PointerTo(f.IndirectFieldType).Implements(encryptedColumnType)
+	if redact && v != nil {
+		return "[REDACTED]"
+	}
+	return v
+}
+
+// normalizeAuditValue make values scanned into maps comparable, drivers return text as []byte
+func normalizeAuditValue(v any) any {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+func eachRecord(rv reflect.Value, fn func(rv reflect.Value)) {
+	rv = reflect.Indirect(rv)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			elem := reflect.Indirect(rv.Index(i))
+			if elem.Kind() == reflect.Struct {
+				fn(elem)
+			}
+		}
+	case reflect.Struct:
+		fn(rv)
+	}
+}
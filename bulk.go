@@ -0,0 +1,265 @@
+package utilities
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// maxStatementParams is the bind parameter limit of one statement on postgres and mysql
+const maxStatementParams = 65535
+
+const (
+	//fail on duplicate keys, the default
+	ConflictError = iota
+	//skip rows which conflict, INSERT IGNORE style
+	ConflictDoNothing
+	//update UpdateColumns (or every column) of the existing row, ON DUPLICATE KEY UPDATE on mysql
+	ConflictUpdate
+)
+
+type BulkOptions struct {
+	//rows per statement, default 1000, lowered when the rows would exceed the bind parameter limit
+	BatchSize int
+	//ConflictError, ConflictDoNothing or ConflictUpdate
+	OnConflict int
+	//conflict target on postgres. ConflictUpdate targets the primary key when empty, ConflictDoNothing any
+	//unique constraint. mysql always uses the unique keys of the table
+	ConflictColumns []string
+	//columns updated by ConflictUpdate, every column when empty
+	UpdateColumns []string
+	//use postgres COPY, the fastest path. conflicts are not handled, hooks and plugin callbacks
+	//(tenant scope, audit) do not run and generated ids are not written back to the rows
+	UseCopy bool
+}
+
+type BulkChunk struct {
+	Offset   int
+	Rows     int
+	Affected int64
+}
+
+type BulkReport struct {
+	Chunks   []BulkChunk
+	Affected int64
+	Duration time.Duration
+}
+
+/*
+BulkInsert insert rows in chunks and report the affected rows of every chunk.
+Each chunk is its own statement, run it inside WithTx to make the whole import atomic.
+On error the report holds the chunks written before the failing one.
+
+	report, err := BulkInsert(db, products, BulkOptions{
+		OnConflict:      ConflictUpdate,
+		ConflictColumns: []string{"sku"},
+		UpdateColumns:   []string{"name", "price"},
+	})
+*/
+func BulkInsert[T any](db *gorm.DB, rows []T, opts BulkOptions) (report BulkReport, err error) {
+	start := time.Now()
+	defer func() { report.Duration = time.Since(start) }()
+
+	if len(rows) == 0 {
+		return report, nil
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(new(T)); err != nil {
+		return report, fmt.Errorf("failed to parse model: %w", err)
+	}
+	cols := bulkColumns(stmt.Schema)
+
+	size := opts.BatchSize
+	if size <= 0 {
+		size = 1000
+	}
+	if len(cols) > 0 {
+		size = min(size, maxStatementParams/len(cols))
+	}
+
+	if opts.UseCopy {
+		if db.Dialector.Name() != Postgresql {
+			return report, fmt.Errorf("copy is only supported on postgres")
+		}
+		if opts.OnConflict != ConflictError {
+			return report, fmt.Errorf("copy does not support conflict strategies")
+		}
+	}
+
+	tx := db.Session(&gorm.Session{CreateBatchSize: size})
+	if c, ok := bulkConflict(stmt.Schema, opts); ok {
+		tx = tx.Clauses(c)
+	}
+
+	for offset := 0; offset < len(rows); offset += size {
+		end := min(offset+size, len(rows))
+		chunk := BulkChunk{Offset: offset, Rows: end - offset}
+
+		if opts.UseCopy {
+			chunk.Affected, err = copyRows(db, stmt.Table, cols, rows[offset:end])
+		} else {
+			res := tx.Create(rows[offset:end])
+			chunk.Affected, err = res.RowsAffected, res.Error
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to bulk insert rows %d-%d: %w", offset, end-1, err)
+		}
+
+		report.Chunks = append(report.Chunks, chunk)
+		report.Affected += chunk.Affected
+	}
+
+	return report, nil
+}
+
+func bulkConflict(sch *schema.Schema, opts BulkOptions) (clause.OnConflict, bool) {
+	var conflict clause.OnConflict
+	for _, c := range opts.ConflictColumns {
+		conflict.Columns = append(conflict.Columns, clause.Column{Name: c})
+	}
+
+	switch opts.OnConflict {
+	case ConflictDoNothing:
+		conflict.DoNothing = true
+	case ConflictUpdate:
+		//postgres needs a target for DO UPDATE
+		if len(conflict.Columns) == 0 {
+			for _, f := range sch.PrimaryFields {
+				conflict.Columns = append(conflict.Columns, clause.Column{Name: f.DBName})
+			}
+		}
+		if len(opts.UpdateColumns) == 0 {
+			conflict.UpdateAll = true
+		} else {
+			conflict.DoUpdates = clause.AssignmentColumns(opts.UpdateColumns)
+		}
+	default:
+		return conflict, false
+	}
+	return conflict, true
+}
+
+// bulkColumns return the fields written by an insert, auto increment keys are left to the database
+func bulkColumns(sch *schema.Schema) []*schema.Field {
+	var cols []*schema.Field
+	for _, f := range sch.Fields {
+		if f.DBName == "" || !f.Creatable || f.AutoIncrement {
+			continue
+		}
+		cols = append(cols, f)
+	}
+	return cols
+}
+
+// copyRows write rows with COPY, through pgx when the pool uses the pgx stdlib driver and lib/pq otherwise
+func copyRows[T any](db *gorm.DB, table string, cols []*schema.Field, rows []T) (int64, error) {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	names := make([]string, len(cols))
+	for i, f := range cols {
+		names[i] = f.DBName
+	}
+
+	now := time.Now()
+	values := make([][]any, len(rows))
+	rv := reflect.ValueOf(rows)
+	for i := range rows {
+		elem := reflect.Indirect(rv.Index(i))
+		values[i] = make([]any, len(cols))
+		for j, f := range cols {
+			v, zero := f.ValueOf(ctx, elem)
+			if zero && (f.AutoCreateTime > 0 || f.AutoUpdateTime > 0) {
+				if err := f.Set(ctx, elem, now); err != nil {
+					return 0, err
+				}
+				v, _ = f.ValueOf(ctx, elem)
+			}
+			values[i][j] = v
+		}
+	}
+
+	//schema per tenant tables are prefixed with the schema
+	ident := strings.Split(table, ".")
+
+	//inside a transaction the copy has to run on the transaction connection
+	pool := db.Statement.ConnPool
+	if p, ok := pool.(*gorm.PreparedStmtTX); ok {
+		pool = p.Tx
+	}
+	if sqlTx, ok := pool.(*sql.Tx); ok {
+		return pqCopy(ctx, sqlTx, ident, names, values)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		return 0, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var affected int64
+	usedPgx := false
+	err = conn.Raw(func(driverConn any) error {
+		pc, ok := driverConn.(interface{ Conn() *pgx.Conn })
+		if !ok {
+			return nil
+		}
+		usedPgx = true
+		var err error
+		affected, err = pc.Conn().CopyFrom(ctx, pgx.Identifier(ident), names, pgx.CopyFromRows(values))
+		return err
+	})
+	if usedPgx || err != nil {
+		return affected, err
+	}
+
+	sqlTx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	affected, err = pqCopy(ctx, sqlTx, ident, names, values)
+	if err != nil {
+		sqlTx.Rollback()
+		return 0, err
+	}
+	return affected, sqlTx.Commit()
+}
+
+func pqCopy(ctx context.Context, tx *sql.Tx, ident, names []string, values [][]any) (int64, error) {
+	query := pq.CopyIn(ident[len(ident)-1], names...)
+	if len(ident) > 1 {
+		query = pq.CopyInSchema(ident[0], ident[1], names...)
+	}
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for _, row := range values {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		return 0, err
+	}
+	return int64(len(values)), nil
+}
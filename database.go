@@ -1,6 +1,7 @@
 package utilities
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -43,6 +44,35 @@ type DBConfiguration struct {
 	MaxIdleConn    int
 	Migrate        bool
 	PreparedStmt   bool
+	//maximum number of tenant pools kept open by DBManager, 0 means unlimited
+	MaxTenantPools int
+	//seconds a tenant pool may stay unused before DBManager closes it, 0 means never
+	TenantIdleTimeout int
+	//read replicas as host:port, plain reads made through DBManager are routed to them
+	ReadReplicas []string
+	//disable, require, verify-ca or verify-full. default disable
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+	//server side statement timeout in milliseconds, statement_timeout on postgres and max_execution_time on mysql.
+	//it applies to every statement of the pool, WithQueryTimeout cannot extend it
+	StatementTimeout int
+	//milliseconds, deadline given by DBManager to statements whose context has none, 0 means no deadline
+	QueryTimeout int
+	//extra driver parameters appended to the connection string
+	Params map[string]string
+	//ping the database in ConnectDB, retrying with exponential backoff until ConnectRetryDeadline
+	PingOnConnect bool
+	//seconds ConnectDB keeps retrying the ping, default ConnectTimeOut
+	ConnectRetryDeadline int
+	//seconds a connection may be reused, default 3600
+	ConnMaxLifetime int
+	//seconds a connection may stay idle in the pool, 0 means no limit
+	ConnMaxIdleTime int
+
+	//malformed DATABASE_URL seen by GetDBConfig, reported by ConnectDB
+	urlErr error
 }
 
 const (
@@ -50,8 +80,20 @@ const (
 	Postgresql = "postgres"
 )
 
+/*
+GetDBConfig read the configuration from env, when DATABASE_URL is set it fills every field
+which is not set by its own env key. A malformed DATABASE_URL is returned by ConnectDB, use GetDBConfigE to get it here
+*/
 func GetDBConfig() DBConfiguration {
+	cfg, err := GetDBConfigE()
+	cfg.urlErr = err
+	return cfg
+}
+
+// GetDBConfigE is GetDBConfig returning the DATABASE_URL parse error, the configuration from the other keys is still returned
+func GetDBConfigE() (DBConfiguration, error) {
 	cfg := DBConfiguration{
+		DbType:         EnvString("DB_TYPE"),
 		Host:           EnvString("DB_HOST"),
 		DBName:         EnvString("DB_NAME"),
 		Username:       EnvString("DB_USERNAME"),
@@ -63,6 +105,31 @@ func GetDBConfig() DBConfiguration {
 		ConnectTimeOut: EnvInt("DB_CONNECT_TIMEOUT"),
 		MaxOpenConn:    EnvInt("DB_MAX_OPEN_CONN"),
 		MaxIdleConn:    EnvInt("DB_MAX_IDLE_CONN"),
+
+		MaxTenantPools:    EnvInt("DB_MAX_TENANT_POOLS"),
+		TenantIdleTimeout: EnvInt("DB_TENANT_IDLE_TIMEOUT"),
+		ReadReplicas:      envList("DB_READ_REPLICAS"),
+
+		SSLMode:          EnvString("DB_SSL_MODE"),
+		SSLRootCert:      EnvString("DB_SSL_ROOT_CERT"),
+		SSLCert:          EnvString("DB_SSL_CERT"),
+		SSLKey:           EnvString("DB_SSL_KEY"),
+		StatementTimeout: EnvInt("DB_STATEMENT_TIMEOUT"),
+		QueryTimeout:     EnvInt("DB_QUERY_TIMEOUT"),
+		Params:           parseParams(EnvString("DB_PARAMS")),
+
+		PingOnConnect:        EnvBool("DB_PING_ON_CONNECT"),
+		ConnectRetryDeadline: EnvInt("DB_CONNECT_RETRY_DEADLINE"),
+		ConnMaxLifetime:      EnvInt("DB_CONN_MAX_LIFETIME"),
+		ConnMaxIdleTime:      EnvInt("DB_CONN_MAX_IDLE_TIME"),
+	}
+
+	var urlErr error
+	if raw := EnvString("DATABASE_URL"); raw != "" {
+		var urlCfg DBConfiguration
+		if urlCfg, urlErr = ParseDatabaseURL(raw); urlErr == nil {
+			cfg = fillDBConfig(cfg, urlCfg)
+		}
 	}
 
 	//default db connection time out
@@ -77,12 +144,62 @@ func GetDBConfig() DBConfiguration {
 	if cfg.MaxIdleConn == 0 {
 		cfg.MaxIdleConn = 10
 	}
+	//default db connection lifetime
+	if cfg.ConnMaxLifetime == 0 {
+		cfg.ConnMaxLifetime = 3600
+	}
 
+	return cfg, urlErr
+}
+
+// fillDBConfig set the connection fields of cfg which are empty from src
+func fillDBConfig(cfg, src DBConfiguration) DBConfiguration {
+	fill := func(dst *string, v string) {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+
+	fill(&cfg.DbType, src.DbType)
+	fill(&cfg.Host, src.Host)
+	fill(&cfg.Port, src.Port)
+	fill(&cfg.DBName, src.DBName)
+	fill(&cfg.Username, src.Username)
+	fill(&cfg.Password, src.Password)
+	fill(&cfg.Schema, src.Schema)
+	fill(&cfg.SessionName, src.SessionName)
+	fill(&cfg.SSLMode, src.SSLMode)
+	fill(&cfg.SSLRootCert, src.SSLRootCert)
+	fill(&cfg.SSLCert, src.SSLCert)
+	fill(&cfg.SSLKey, src.SSLKey)
+
+	if cfg.ConnectTimeOut == 0 {
+		cfg.ConnectTimeOut = src.ConnectTimeOut
+	}
+	if cfg.StatementTimeout == 0 {
+		cfg.StatementTimeout = src.StatementTimeout
+	}
+	for key, v := range src.Params {
+		if cfg.Params == nil {
+			cfg.Params = map[string]string{}
+		}
+		if _, ok := cfg.Params[key]; !ok {
+			cfg.Params[key] = v
+		}
+	}
 	return cfg
 }
 
 func ConnectDB(cfg DBConfiguration) (*sql.DB, error) {
-	connString := makeConnString(cfg.DbType, cfg.SessionName, cfg.Host, cfg.Port, cfg.Username, cfg.DBName, cfg.Password, cfg.ConnectTimeOut)
+	if cfg.urlErr != nil {
+		return nil, fmt.Errorf("invalid DATABASE_URL: %w", cfg.urlErr)
+	}
+
+	connString, err := makeConnString(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	sql, err := sql.Open(cfg.DbType, connString)
 	if err != nil {
 		return nil, err
@@ -90,11 +207,54 @@ func ConnectDB(cfg DBConfiguration) (*sql.DB, error) {
 
 	sql.SetMaxIdleConns(cfg.MaxIdleConn)
 	sql.SetMaxOpenConns(cfg.MaxOpenConn)
-	sql.SetConnMaxLifetime(time.Hour)
+
+	lifetime := time.Duration(cfg.ConnMaxLifetime) * time.Second
+	if lifetime == 0 {
+		lifetime = time.Hour
+	}
+	sql.SetConnMaxLifetime(lifetime)
+	sql.SetConnMaxIdleTime(time.Duration(cfg.ConnMaxIdleTime) * time.Second)
+
+	if cfg.PingOnConnect {
+		if err := pingWithRetry(sql, cfg); err != nil {
+			sql.Close()
+			return nil, err
+		}
+	}
 
 	return sql, nil
 }
 
+// pingWithRetry ping db with exponential backoff until it answers or the retry deadline is reached
+func pingWithRetry(db *sql.DB, cfg DBConfiguration) error {
+	deadline := cfg.ConnectRetryDeadline
+	if deadline <= 0 {
+		deadline = cfg.ConnectTimeOut
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(deadline)*time.Second)
+	defer cancel()
+
+	backoff := 200 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to ping %s:%s/%s after %d attempts: %w", cfg.Host, cfg.Port, cfg.DBName, attempt, err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > 5*time.Second {
+			backoff = 5 * time.Second
+		}
+	}
+}
+
 func InitGorm(sqlConn *sql.DB, cfg DBConfiguration) (*gorm.DB, error) {
 	dbLogger := CreateLogger(cfg.Logging)
 	db, err := NewGormDB(cfg.DbType, sqlConn, dbLogger, cfg.Logging)
@@ -104,16 +264,6 @@ func InitGorm(sqlConn *sql.DB, cfg DBConfiguration) (*gorm.DB, error) {
 	return db, nil
 }
 
-func makeConnString(dbtype, conName, host, port, user, dbname, password string, timeOut int) string {
-	if dbtype == Postgresql {
-		return fmt.Sprintf("host=%s port=%s user=%s dbname=%s sslmode=disable password=%s connect_timeout=%d application_name=%s",
-			host, port, user, dbname, password, timeOut, conName)
-	}
-
-	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		user, password, host, port, dbname)
-}
-
 func CreateLogger(debug bool) logger.Interface {
 	level := logger.Silent
 	if debug {
@@ -132,18 +282,28 @@ func CreateLogger(debug bool) logger.Interface {
 }
 
 func NewGormDB(dbtype string, conn *sql.DB, log logger.Interface, preparedStatement bool) (*gorm.DB, error) {
+	return gorm.Open(gormDialector(dbtype, conn), gormConfig(dbtype, log, preparedStatement))
+}
+
+func gormDialector(dbtype string, conn *sql.DB) gorm.Dialector {
 	if dbtype == Mysql {
-		return gorm.Open(mysql.New(mysql.Config{
+		return mysql.New(mysql.Config{
 			Conn:                      conn,
 			SkipInitializeWithVersion: true,
-		}), &gorm.Config{
+		})
+	}
+
+	return postgres.New(postgres.Config{Conn: conn})
+}
+
+func gormConfig(dbtype string, log logger.Interface, preparedStatement bool) *gorm.Config {
+	if dbtype == Mysql {
+		return &gorm.Config{
 			SkipDefaultTransaction: true,
 			Logger:                 log,
 			PrepareStmt:            preparedStatement,
-		})
+		}
 	}
 
-	return gorm.Open(postgres.New(
-		postgres.Config{Conn: conn}),
-		&gorm.Config{Logger: log, PrepareStmt: preparedStatement})
+	return &gorm.Config{Logger: log, PrepareStmt: preparedStatement}
 }
@@ -0,0 +1,122 @@
+package utilities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrNotFound is returned when the requested record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a write violates a unique or foreign key constraint
+	ErrConflict = errors.New("conflict")
+)
+
+// postgres SQLSTATE codes
+const (
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+	pgForeignKeyViolation  = "23503"
+	pgUniqueViolation      = "23505"
+	pgQueryCanceled        = "57014"
+)
+
+// mysql error numbers
+const (
+	mysqlDuplicateEntry  = 1062
+	mysqlDeadlock        = 1213
+	mysqlRowIsReferenced = 1451
+	mysqlNoReferencedRow = 1452
+	mysqlQueryTimeout    = 3024
+)
+
+// pgErrorCode return the SQLSTATE of a postgres error from lib/pq or pgx, empty for other errors
+func pgErrorCode(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+
+	return ""
+}
+
+// mysqlErrorNumber return the error number of a mysql error, 0 for other errors
+func mysqlErrorNumber(err error) uint16 {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		return myErr.Number
+	}
+	return 0
+}
+
+// IsRetryableTxError report whether err is a serialization failure or deadlock, after which the transaction can be retried
+func IsRetryableTxError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch pgErrorCode(err) {
+	case pgSerializationFailure, pgDeadlockDetected:
+		return true
+	}
+
+	return mysqlErrorNumber(err) == mysqlDeadlock
+}
+
+// IsConflictError report whether err is a unique or foreign key violation
+func IsConflictError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, gorm.ErrDuplicatedKey) || errors.Is(err, gorm.ErrForeignKeyViolated) {
+		return true
+	}
+
+	switch pgErrorCode(err) {
+	case pgUniqueViolation, pgForeignKeyViolation:
+		return true
+	}
+
+	switch mysqlErrorNumber(err) {
+	case mysqlDuplicateEntry, mysqlRowIsReferenced, mysqlNoReferencedRow:
+		return true
+	}
+	return false
+}
+
+// IsQueryTimeout report whether err is a client deadline, a postgres statement_timeout or a mysql max_execution_time
+func IsQueryTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrQueryTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return pgErrorCode(err) == pgQueryCanceled || mysqlErrorNumber(err) == mysqlQueryTimeout
+}
+
+// mapDBError wrap driver and gorm errors with ErrNotFound, ErrConflict or ErrQueryTimeout, the original error stays in the chain
+func mapDBError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	case IsConflictError(err):
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	case IsQueryTimeout(err) && !errors.Is(err, ErrQueryTimeout):
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	}
+	return err
+}
@@ -2,13 +2,18 @@ package utilities
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/stretchr/testify/mock"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
 )
 
 type MockDBManager struct {
@@ -25,17 +30,106 @@ func (m *MockDBManager) CloseConnections() error {
 	return args.Error(0)
 }
 
+func (m *MockDBManager) Ping(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func (m *MockDBManager) Stats() map[string]sql.DBStats {
+	args := m.Called()
+	return args.Get(0).(map[string]sql.DBStats)
+}
+
+func (m *MockDBManager) Snapshot() DBManagerSnapshot {
+	args := m.Called()
+	return args.Get(0).(DBManagerSnapshot)
+}
+
+type DBManagerOption func(*dbmanager)
+
+// WithTenantResolver resolve the connection configuration of each tenant with resolver
+// instead of cloning the default configuration
+func WithTenantResolver(resolver TenantResolver) DBManagerOption {
+	return func(m *dbmanager) {
+		m.resolver = resolver
+	}
+}
+
+// WithGormLogger use log for every tenant instead of the logger made from the Logging flag
+func WithGormLogger(log logger.Interface) DBManagerOption {
+	return func(m *dbmanager) {
+		m.logger = log
+	}
+}
+
+// WithGormPlugins register plugins on the GORM instance of every tenant
+func WithGormPlugins(plugins ...gorm.Plugin) DBManagerOption {
+	return func(m *dbmanager) {
+		m.plugins = append(m.plugins, plugins...)
+	}
+}
+
+// WithSchemaPerTenant share one pool opened from the default configuration between all tenants
+// and scope every tenant to its own schema instead of its own database.
+// The schema is the Schema resolved for the tenant, or the tenant key when empty.
+// GORM does not prefix db.Table and models implementing TableName, qualify those with TenantTable:
+// statements on a table without schema fail with ErrUnqualifiedTable instead of reaching the shared search_path.
+func WithSchemaPerTenant() DBManagerOption {
+	return func(m *dbmanager) {
+		m.schemaMode = true
+	}
+}
+
 // Multi database connection manager
-func NewDBManager(defaultConfig DBConfiguration) DBManager {
-	return &dbmanager{
-		connections: make(map[string]*gorm.DB),
+func NewDBManager(defaultConfig DBConfiguration, opts ...DBManagerOption) DBManager {
+	m := &dbmanager{
+		connections: make(map[string]*tenantConn),
 		config:      defaultConfig,
+		stop:        make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(m)
 	}
+
+	if defaultConfig.MaxTenantPools > 0 || defaultConfig.TenantIdleTimeout > 0 {
+		go m.janitor()
+	}
+
+	return m
 }
 
 type DBManager interface {
 	DB(ctx context.Context) (*gorm.DB, error)
 	CloseConnections() error
+	// Ping the tenant database of ctx, or every open pool when ctx carries no tenant
+	Ping(ctx context.Context) error
+	// Stats of every open pool keyed by tenant
+	Stats() map[string]sql.DBStats
+	// Snapshot of the pools and counters of the manager, ready to be exported as json
+	Snapshot() DBManagerSnapshot
+}
+
+// evicted pools are closed only after this grace period and once no connection is in use,
+// so callers still holding a *gorm.DB from an evicted tenant can finish their queries
+const tenantDrainGrace = 30 * time.Second
+
+type tenantConn struct {
+	key      string
+	db       *gorm.DB
+	openedAt time.Time
+	replicas *replicaSet
+	//unix nanoseconds, updated without m.mu so DB only needs the read lock
+	lastUsed atomic.Int64
+	//shared is set when the pool belongs to the manager (schema per tenant mode) and must not be closed on eviction
+	shared bool
+}
+
+type drainingConn struct {
+	key       string
+	db        *gorm.DB
+	replicas  *replicaSet
+	evictedAt time.Time
 }
 
 /*
@@ -43,33 +137,71 @@ Use context to pass value of database and db username
 example :
 ctx.WithValue("dbname", "db1")
 ctx.WithValue("dbuser", "user1")
+
+With a TenantResolver, "dbname" is the tenant key passed to the resolver and "dbuser" is optional.
+
+When MaxTenantPools is set, the least recently used tenant pool is evicted once the cap is reached.
+When TenantIdleTimeout is set, tenant pools unused for that long are evicted by a background janitor.
 */
 type dbmanager struct {
-	connections map[string]*gorm.DB
+	connections map[string]*tenantConn
+	draining    []drainingConn
 	mu          sync.RWMutex
 	config      DBConfiguration
+	resolver    TenantResolver
+	schemaMode  bool
+	logger      logger.Interface
+	plugins     []gorm.Plugin
+	shared      *sql.DB
+	sharedRepl  *replicaSet
+	opened      int64
+	evicted     int64
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+// TenantContext set the tenant database name and username read by DBManager.DB, empty values are not set
+func TenantContext(ctx context.Context, dbname, dbuser string) context.Context {
+	if dbname != "" {
+		ctx = context.WithValue(ctx, "dbname", dbname)
+	}
+	if dbuser != "" {
+		ctx = context.WithValue(ctx, "dbuser", dbuser)
+	}
+	return ctx
+}
+
+func contextString(ctx context.Context, key string) string {
+	v := ctx.Value(key)
+	if v == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", v)
 }
 
 func (m *dbmanager) DB(ctx context.Context) (*gorm.DB, error) {
-	dbName := fmt.Sprintf("%s", ctx.Value("dbname"))
-	dbUser := fmt.Sprintf("%s", ctx.Value("dbuser"))
+	dbName := contextString(ctx, "dbname")
 	if dbName == "" {
 		return nil, fmt.Errorf("database name is required")
 	}
 
-	if dbUser == "" {
-		return nil, fmt.Errorf("database username is required")
-	}
-
 	m.mu.RLock()
-	db, exists := m.connections[dbName]
+	conn, exists := m.connections[dbName]
+	if exists {
+		m.touch(conn)
+	}
 	m.mu.RUnlock()
 
 	if exists {
-		return db.WithContext(ctx), nil
+		return conn.db.WithContext(ctx), nil
+	}
+
+	dbConfig, err := m.tenantConfig(ctx, dbName)
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := m.createConnection(dbName, dbUser)
+	db, err := m.createConnection(dbName, dbConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create connection: %w", err)
 	}
@@ -77,54 +209,372 @@ func (m *dbmanager) DB(ctx context.Context) (*gorm.DB, error) {
 	return db.WithContext(ctx), nil
 }
 
-func (m *dbmanager) createConnection(dbname, dbuser string) (*gorm.DB, error) {
+func (m *dbmanager) tenantConfig(ctx context.Context, tenant string) (DBConfiguration, error) {
+	dbUser := contextString(ctx, "dbuser")
+
+	if m.resolver == nil {
+		if m.schemaMode {
+			dbConfig := m.config
+			dbConfig.Schema = tenant
+			return dbConfig, nil
+		}
+
+		if dbUser == "" {
+			return DBConfiguration{}, fmt.Errorf("database username is required")
+		}
+
+		// Clone base config and modify for tenant
+		dbConfig := m.config
+		dbConfig.DBName = tenant
+		dbConfig.Username = dbUser
+		return dbConfig, nil
+	}
+
+	resolved, err := m.resolver.Resolve(ctx, tenant)
+	if err != nil {
+		return DBConfiguration{}, fmt.Errorf("failed to resolve tenant: %w", err)
+	}
+
+	if resolved.DBName == "" {
+		resolved.DBName = tenant
+	}
+	if resolved.Username == "" {
+		resolved.Username = dbUser
+	}
+
+	if m.schemaMode && resolved.Schema == "" {
+		resolved.Schema = tenant
+	}
+
+	return mergeDBConfig(m.config, resolved), nil
+}
+
+// touch marks the tenant as most recently used, caller must hold m.mu for reading at least
+func (m *dbmanager) touch(conn *tenantConn) {
+	conn.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (c *tenantConn) used() time.Time {
+	return time.Unix(0, c.lastUsed.Load())
+}
+
+// leastRecentlyUsed return the tenant pool used the longest time ago, caller must hold m.mu
+func (m *dbmanager) leastRecentlyUsed() *tenantConn {
+	var lru *tenantConn
+	for _, conn := range m.connections {
+		if lru == nil || conn.lastUsed.Load() < lru.lastUsed.Load() {
+			lru = conn
+		}
+	}
+	return lru
+}
+
+func (m *dbmanager) createConnection(dbname string, dbConfig DBConfiguration) (*gorm.DB, error) {
+	if m.schemaMode {
+		// Open outside the lock too, the shared pool may wait for ping retries
+		db, err := m.openSchemaTenant(dbConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := m.usePlugins(db, dbConfig); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		// Another request opened the tenant meanwhile, keep that one. The pool is shared so nothing is closed
+		if conn, exists := m.connections[dbname]; exists {
+			m.touch(conn)
+			return conn.db, nil
+		}
+
+		m.register(dbname, db, nil)
+		return db, nil
+	}
+
+	// Open outside the lock, connecting may wait for ping retries
+	db, replicas, err := openTenant(dbConfig, m.gormLogger(dbConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.usePlugins(db, dbConfig); err != nil {
+		closeTenant(db, replicas)
+		return nil, err
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Double-check if connection was created while waiting for lock
-	if db, exists := m.connections[dbname]; exists {
-		return db, nil
+	// Another request opened the tenant meanwhile, keep that one
+	if conn, exists := m.connections[dbname]; exists {
+		m.touch(conn)
+		closeTenant(db, replicas)
+		return conn.db, nil
+	}
+
+	m.register(dbname, db, replicas)
+	return db, nil
+}
+
+// register add the tenant pool as most recently used, caller must hold m.mu
+func (m *dbmanager) register(dbname string, db *gorm.DB, replicas *replicaSet) {
+	// Make room for the new tenant
+	if m.config.MaxTenantPools > 0 {
+		for len(m.connections) >= m.config.MaxTenantPools {
+			m.evict(m.leastRecentlyUsed())
+		}
 	}
 
-	// Clone base config and modify for tenant
-	dbConfig := m.config
-	dbConfig.DBName = dbname
-	dbConfig.Username = dbuser
+	conn := &tenantConn{key: dbname, db: db, replicas: replicas, openedAt: time.Now(), shared: m.schemaMode}
+	m.touch(conn)
+	m.connections[dbname] = conn
+	m.opened++
+}
 
+func (m *dbmanager) usePlugins(db *gorm.DB, dbConfig DBConfiguration) error {
+	plugins := m.plugins
+	if dbConfig.QueryTimeout > 0 {
+		plugins = append([]gorm.Plugin{NewQueryTimeoutPlugin(time.Duration(dbConfig.QueryTimeout) * time.Millisecond)}, plugins...)
+	}
+
+	for _, plugin := range plugins {
+		if err := db.Use(plugin); err != nil {
+			return fmt.Errorf("failed to register plugin %s: %w", plugin.Name(), err)
+		}
+	}
+	return nil
+}
+
+func closeTenant(db *gorm.DB, replicas *replicaSet) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+	if replicas != nil {
+		replicas.close()
+	}
+}
+
+func (m *dbmanager) gormLogger(dbConfig DBConfiguration) logger.Interface {
+	if m.logger != nil {
+		return m.logger
+	}
+	return CreateLogger(dbConfig.Logging)
+}
+
+func openTenant(dbConfig DBConfiguration, log logger.Interface) (*gorm.DB, *replicaSet, error) {
 	// Create new connection
 	sqlConn, err := ConnectDB(dbConfig)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to tenant database: %w", err)
+		return nil, nil, fmt.Errorf("failed to connect to tenant database: %w", err)
 	}
 
 	// Initialize GORM
-	db, err := gorm.Open(postgres.New(postgres.Config{
-		Conn: sqlConn,
-	}), &gorm.Config{})
+	db, err := NewGormDB(dbConfig.DbType, sqlConn, log, dbConfig.PreparedStmt)
+	if err != nil {
+		sqlConn.Close()
+		return nil, nil, fmt.Errorf("failed to initialize GORM: %w", err)
+	}
+
+	if len(dbConfig.ReadReplicas) == 0 {
+		return db, nil, nil
+	}
+
+	replicas, err := newReplicaSet(dbConfig)
+	if err == nil {
+		err = db.Use(replicas)
+	}
+	if err != nil {
+		sqlConn.Close()
+		if replicas != nil {
+			replicas.close()
+		}
+		return nil, nil, fmt.Errorf("failed to initialize read replicas: %w", err)
+	}
+
+	return db, replicas, nil
+}
+
+// sharedPool return the pool shared by the tenants in schema per tenant mode, opening it on first use.
+// It connects without holding m.mu, a concurrent open keeps the first pool stored
+func (m *dbmanager) sharedPool() (*sql.DB, *replicaSet, error) {
+	m.mu.RLock()
+	shared, sharedRepl := m.shared, m.sharedRepl
+	m.mu.RUnlock()
+	if shared != nil {
+		return shared, sharedRepl, nil
+	}
+
+	sqlConn, err := ConnectDB(m.config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to shared database: %w", err)
+	}
+
+	var replicas *replicaSet
+	if len(m.config.ReadReplicas) > 0 {
+		if replicas, err = newReplicaSet(m.config); err != nil {
+			sqlConn.Close()
+			return nil, nil, fmt.Errorf("failed to initialize read replicas: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.shared != nil {
+		sqlConn.Close()
+		if replicas != nil {
+			replicas.close()
+		}
+		return m.shared, m.sharedRepl, nil
+	}
+	m.shared, m.sharedRepl = sqlConn, replicas
+	return sqlConn, replicas, nil
+}
+
+// openSchemaTenant opens a GORM instance over the shared pool which prefixes every table with the tenant schema
+func (m *dbmanager) openSchemaTenant(dbConfig DBConfiguration) (*gorm.DB, error) {
+	if !validIdentifier(dbConfig.Schema) {
+		return nil, fmt.Errorf("invalid tenant schema %q", dbConfig.Schema)
+	}
+
+	shared, sharedRepl, err := m.sharedPool()
+	if err != nil {
+		return nil, err
+	}
+
+	//table prefix keeps the schema inside the generated sql, so pooled connections and
+	//prepared statements never depend on the session search_path
+	cfg := gormConfig(m.config.DbType, m.gormLogger(m.config), m.config.PreparedStmt)
+	cfg.NamingStrategy = schema.NamingStrategy{TablePrefix: dbConfig.Schema + "."}
+
+	db, err := gorm.Open(gormDialector(m.config.DbType, shared), cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize GORM: %w", err)
 	}
 
-	m.connections[dbname] = db
-	return db, nil
+	if err := db.Use(schemaGuard{}); err != nil {
+		return nil, fmt.Errorf("failed to register plugin %s: %w", schemaGuard{}.Name(), err)
+	}
+
+	if sharedRepl != nil {
+		if err := db.Use(sharedRepl); err != nil {
+			return nil, fmt.Errorf("failed to initialize read replicas: %w", err)
+		}
+	}
+
+	return db.Set(tenantSchemaKey, dbConfig.Schema).Session(&gorm.Session{}), nil
 }
 
-// Close all connections before exit application
-func (m *dbmanager) CloseConnections() error {
+// evict removes the tenant from the pool map and queues its pool for closing, caller must hold m.mu
+func (m *dbmanager) evict(conn *tenantConn) {
+	delete(m.connections, conn.key)
+	m.evicted++
+	if conn.shared {
+		return
+	}
+	m.draining = append(m.draining, drainingConn{key: conn.key, db: conn.db, replicas: conn.replicas, evictedAt: time.Now()})
+}
+
+func (m *dbmanager) janitor() {
+	interval := tenantDrainGrace
+	if idle := time.Duration(m.config.TenantIdleTimeout) * time.Second; idle > 0 && idle/2 < interval {
+		interval = idle / 2
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.evictIdle()
+			m.closeDrained(false)
+		}
+	}
+}
+
+func (m *dbmanager) evictIdle() {
+	if m.config.TenantIdleTimeout <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(-time.Duration(m.config.TenantIdleTimeout) * time.Second)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, conn := range m.connections {
+		if conn.used().Before(deadline) {
+			m.evict(conn)
+		}
+	}
+}
+
+// closeDrained closes evicted pools that have no connection in use, or all of them when force is set
+func (m *dbmanager) closeDrained(force bool) []error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	var errs []error
-	for tenantID, db := range m.connections {
-		sqlDB, err := db.DB()
+	remaining := m.draining[:0]
+	for _, d := range m.draining {
+		sqlDB, err := d.db.DB()
 		if err != nil {
-			errs = append(errs, fmt.Errorf("tenant %s: %w", tenantID, err))
+			errs = append(errs, fmt.Errorf("tenant %s: %w", d.key, err))
+			continue
+		}
+
+		if !force && (time.Since(d.evictedAt) < tenantDrainGrace || sqlDB.Stats().InUse > 0) {
+			remaining = append(remaining, d)
 			continue
 		}
+
 		if err := sqlDB.Close(); err != nil {
-			errs = append(errs, fmt.Errorf("tenant %s: %w", tenantID, err))
+			errs = append(errs, fmt.Errorf("tenant %s: %w", d.key, err))
+		}
+		if d.replicas != nil {
+			for _, err := range d.replicas.close() {
+				errs = append(errs, fmt.Errorf("tenant %s: %w", d.key, err))
+			}
+		}
+	}
+	m.draining = remaining
+
+	return errs
+}
+
+// Close all connections before exit application
+func (m *dbmanager) CloseConnections() error {
+	m.stopOnce.Do(func() { close(m.stop) })
+
+	m.mu.Lock()
+	for _, conn := range m.connections {
+		m.evict(conn)
+	}
+	m.mu.Unlock()
+
+	errs := m.closeDrained(true)
+
+	m.mu.Lock()
+	if m.shared != nil {
+		if err := m.shared.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("shared pool: %w", err))
 		}
+		m.shared = nil
 	}
+	if m.sharedRepl != nil {
+		errs = append(errs, m.sharedRepl.close()...)
+		m.sharedRepl = nil
+	}
+	m.mu.Unlock()
 
 	if len(errs) > 0 {
 		return fmt.Errorf("errors closing connections: %v", errs)
@@ -141,6 +591,7 @@ func WithDB(dbm DBManager, ctx context.Context, fn func(db *gorm.DB) error) erro
 	return fn(db)
 }
 
+// Paging apply offset and limit as given, bound user supplied values first or use ParseListQuery which caps them
 func Paging(page, limit int) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
 		offset := (page - 1) * limit
@@ -148,6 +599,8 @@ func Paging(page, limit int) func(db *gorm.DB) *gorm.DB {
 	}
 }
 
+// Sorting order by a single column, columns which are not plain identifiers are ignored.
+// For user supplied sort parameters prefer ParseListQuery and FindList which check a whitelist
 func Sorting(sort, order *string) func(db *gorm.DB) *gorm.DB {
 	return func(db *gorm.DB) *gorm.DB {
 		if sort == nil || order == nil {
@@ -161,6 +614,12 @@ func Sorting(sort, order *string) func(db *gorm.DB) *gorm.DB {
 			return db
 		}
 
-		return db.Order(fmt.Sprintf("%s %s", col, dir))
+		for _, part := range strings.Split(col, ".") {
+			if !validIdentifier(part) {
+				return db
+			}
+		}
+
+		return db.Order(clause.OrderByColumn{Column: clause.Column{Name: col}, Desc: dir == "desc"})
 	}
 }
@@ -0,0 +1,195 @@
+package utilities
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const replicaHealthInterval = 10 * time.Second
+
+type forcePrimaryKey struct{}
+
+// ForcePrimary route every query made with ctx to the primary, use it to read your own writes
+func ForcePrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forcePrimaryKey{}, true)
+}
+
+func isForcePrimary(ctx context.Context) bool {
+	v, _ := ctx.Value(forcePrimaryKey{}).(bool)
+	return v
+}
+
+type useReplicaKey struct{}
+
+/*
+UseReplica let raw SELECT statements made with ctx go to a read replica, they stay on the primary otherwise
+since a select may call functions with side effects. Selects with a locking clause still go to the primary.
+
+	db, _ := dbm.DB(UseReplica(ctx))
+	db.Raw("SELECT status, count(*) FROM orders GROUP BY status").Scan(&counts)
+*/
+func UseReplica(ctx context.Context) context.Context {
+	return context.WithValue(ctx, useReplicaKey{}, true)
+}
+
+func isUseReplica(ctx context.Context) bool {
+	v, _ := ctx.Value(useReplicaKey{}).(bool)
+	return v
+}
+
+var (
+	plainSelectPattern = regexp.MustCompile(`(?i)^\s*SELECT\b`)
+	lockingReadPattern = regexp.MustCompile(`(?i)\bFOR\s+(NO\s+KEY\s+)?(UPDATE|SHARE|KEY\s+SHARE)\b|\bLOCK\s+IN\s+SHARE\s+MODE\b`)
+)
+
+// replicaSafeRaw report whether raw sql may run on a replica, only plain selects without locking clause
+func replicaSafeRaw(sql string) bool {
+	return plainSelectPattern.MatchString(sql) && !lockingReadPattern.MatchString(sql)
+}
+
+type replica struct {
+	addr    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+/*
+replicaSet is a GORM plugin routing plain reads to healthy read replicas in round robin.
+Writes, raw sql without UseReplica, locking reads and everything inside a transaction stay on the primary,
+and reads fall back to the primary when no replica is healthy.
+*/
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newReplicaSet(cfg DBConfiguration) (*replicaSet, error) {
+	rs := &replicaSet{stop: make(chan struct{})}
+	for _, addr := range cfg.ReadReplicas {
+		replicaCfg := cfg
+		replicaCfg.Host, replicaCfg.Port = splitReplicaAddr(addr, cfg.Port)
+		//an unreachable replica is handled by the health check, it must not fail the tenant
+		replicaCfg.PingOnConnect = false
+
+		sqlConn, err := ConnectDB(replicaCfg)
+		if err != nil {
+			rs.close()
+			return nil, fmt.Errorf("failed to connect to replica %s: %w", addr, err)
+		}
+
+		r := &replica{addr: addr, db: sqlConn}
+		r.healthy.Store(true)
+		rs.replicas = append(rs.replicas, r)
+	}
+
+	go rs.healthLoop()
+	return rs, nil
+}
+
+func splitReplicaAddr(addr, defaultPort string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, defaultPort
+	}
+	return host, port
+}
+
+func (rs *replicaSet) Name() string {
+	return "utilities:replicas"
+}
+
+func (rs *replicaSet) Initialize(db *gorm.DB) error {
+	if err := db.Callback().Query().Before("gorm:query").Register("utilities:replica_query", rs.route); err != nil {
+		return err
+	}
+	return db.Callback().Row().Before("gorm:row").Register("utilities:replica_row", rs.route)
+}
+
+func (rs *replicaSet) route(db *gorm.DB) {
+	stmt := db.Statement
+	if isForcePrimary(stmt.Context) {
+		return
+	}
+
+	//transactions always stay on the primary
+	if _, ok := stmt.ConnPool.(gorm.TxCommitter); ok {
+		return
+	}
+
+	//locking reads must hit the primary
+	if _, ok := stmt.Clauses["FOR"]; ok {
+		return
+	}
+
+	//raw sql is only routed when the caller opted in and it is a plain select
+	if stmt.SQL.Len() > 0 && (!isUseReplica(stmt.Context) || !replicaSafeRaw(stmt.SQL.String())) {
+		return
+	}
+
+	if r := rs.pick(); r != nil {
+		stmt.ConnPool = r.db
+	}
+}
+
+func (rs *replicaSet) pick() *replica {
+	n := len(rs.replicas)
+	start := rs.next.Add(1)
+	for i := 0; i < n; i++ {
+		r := rs.replicas[(start+uint64(i))%uint64(n)]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+func (rs *replicaSet) healthLoop() {
+	ticker := time.NewTicker(replicaHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		rs.checkHealth()
+
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rs *replicaSet) checkHealth() {
+	for _, r := range rs.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaHealthInterval/2)
+		r.healthy.Store(r.db.PingContext(ctx) == nil)
+		cancel()
+	}
+}
+
+func (rs *replicaSet) stats(prefix string, stats map[string]sql.DBStats) {
+	for _, r := range rs.replicas {
+		stats[prefix+"@"+r.addr] = r.db.Stats()
+	}
+}
+
+func (rs *replicaSet) close() []error {
+	rs.stopOnce.Do(func() { close(rs.stop) })
+
+	var errs []error
+	for _, r := range rs.replicas {
+		if err := r.db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("replica %s: %w", r.addr, err))
+		}
+	}
+	return errs
+}
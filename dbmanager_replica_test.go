@@ -0,0 +1,73 @@
+package utilities
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+func TestReplicaSafeRaw(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"SELECT * FROM orders", true},
+		{"  select id from orders where status = 'for update'", false},
+		{"SELECT * FROM orders FOR UPDATE", false},
+		{"SELECT * FROM orders FOR NO KEY UPDATE SKIP LOCKED", false},
+		{"SELECT * FROM orders for share", false},
+		{"SELECT * FROM orders FOR KEY SHARE", false},
+		{"SELECT * FROM orders LOCK IN SHARE MODE", false},
+		{"UPDATE orders SET status = 'paid'", false},
+		{"WITH x AS (DELETE FROM orders RETURNING *) SELECT * FROM x", false},
+		{"SELECTED", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, replicaSafeRaw(tt.sql), tt.sql)
+	}
+}
+
+func TestReplicaRoute(t *testing.T) {
+	conn, err := sql.Open(Postgresql, "")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := &replica{addr: "replica:5432", db: conn}
+	r.healthy.Store(true)
+	rs := &replicaSet{replicas: []*replica{r}}
+	db := dryRunDB(t, Postgresql)
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		build   func(tx *gorm.DB) *gorm.DB
+		replica bool
+	}{
+		{"query", context.Background(), func(tx *gorm.DB) *gorm.DB { return tx.Table("orders") }, true},
+		{"locking query", context.Background(), func(tx *gorm.DB) *gorm.DB {
+			return tx.Table("orders").Clauses(clause.Locking{Strength: "UPDATE"})
+		}, false},
+		{"force primary", ForcePrimary(context.Background()), func(tx *gorm.DB) *gorm.DB { return tx.Table("orders") }, false},
+		{"raw select", context.Background(), func(tx *gorm.DB) *gorm.DB { return tx.Raw("SELECT nextval('seq')") }, false},
+		{"raw select opted in", UseReplica(context.Background()), func(tx *gorm.DB) *gorm.DB {
+			return tx.Raw("SELECT count(*) FROM orders")
+		}, true},
+		{"raw locking select opted in", UseReplica(context.Background()), func(tx *gorm.DB) *gorm.DB {
+			return tx.Raw("SELECT * FROM orders FOR UPDATE")
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := tt.build(db.WithContext(tt.ctx))
+			rs.route(tx)
+			assert.Equal(t, tt.replica, tx.Statement.ConnPool == gorm.ConnPool(conn))
+		})
+	}
+}
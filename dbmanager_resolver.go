@@ -0,0 +1,367 @@
+package utilities
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// TenantResolver returns the connection configuration of a tenant.
+// Zero valued fields of the returned configuration fall back to the DBManager default configuration.
+type TenantResolver interface {
+	Resolve(ctx context.Context, tenant string) (DBConfiguration, error)
+}
+
+// TenantLister list every tenant key known to a resolver, all resolvers of this package implement it
+type TenantLister interface {
+	Tenants(ctx context.Context) ([]string, error)
+}
+
+// TenantRecord is the serialized form of a tenant configuration, used by the JSON file and table resolvers
+type TenantRecord struct {
+	TenantKey   string `json:"tenant_key" gorm:"column:tenant_key;primaryKey"`
+	DbType      string `json:"db_type" gorm:"column:db_type"`
+	Host        string `json:"host" gorm:"column:host"`
+	Port        string `json:"port" gorm:"column:port"`
+	DBName      string `json:"db_name" gorm:"column:db_name"`
+	Schema      string `json:"schema" gorm:"column:schema"`
+	Username    string `json:"username" gorm:"column:username"`
+	Password    string `json:"password" gorm:"column:password"`
+	MaxOpenConn int    `json:"max_open_conn" gorm:"column:max_open_conn"`
+	MaxIdleConn int    `json:"max_idle_conn" gorm:"column:max_idle_conn"`
+	//comma separated host:port list
+	ReadReplicas string `json:"read_replicas" gorm:"column:read_replicas"`
+	SSLMode      string `json:"ssl_mode" gorm:"column:ssl_mode"`
+	SSLRootCert  string `json:"ssl_root_cert" gorm:"column:ssl_root_cert"`
+	SSLCert      string `json:"ssl_cert" gorm:"column:ssl_cert"`
+	SSLKey       string `json:"ssl_key" gorm:"column:ssl_key"`
+	//milliseconds, see DBConfiguration
+	StatementTimeout int `json:"statement_timeout" gorm:"column:statement_timeout"`
+	QueryTimeout     int `json:"query_timeout" gorm:"column:query_timeout"`
+	//extra driver parameters as k1=v1&k2=v2
+	Params string `json:"params" gorm:"column:params"`
+}
+
+func (r TenantRecord) Config() DBConfiguration {
+	cfg := DBConfiguration{
+		DbType:      r.DbType,
+		Host:        r.Host,
+		Port:        r.Port,
+		DBName:      r.DBName,
+		Schema:      r.Schema,
+		Username:    r.Username,
+		Password:    r.Password,
+		MaxOpenConn: r.MaxOpenConn,
+		MaxIdleConn: r.MaxIdleConn,
+
+		SSLMode:          r.SSLMode,
+		SSLRootCert:      r.SSLRootCert,
+		SSLCert:          r.SSLCert,
+		SSLKey:           r.SSLKey,
+		StatementTimeout: r.StatementTimeout,
+		QueryTimeout:     r.QueryTimeout,
+		Params:           parseParams(r.Params),
+	}
+
+	for _, addr := range strings.Split(r.ReadReplicas, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cfg.ReadReplicas = append(cfg.ReadReplicas, addr)
+		}
+	}
+
+	return cfg
+}
+
+// mergeDBConfig fills the empty fields of tenant with the values of base
+func mergeDBConfig(base, tenant DBConfiguration) DBConfiguration {
+	cfg := base
+	if tenant.DbType != "" {
+		cfg.DbType = tenant.DbType
+	}
+	if tenant.Host != "" {
+		cfg.Host = tenant.Host
+	}
+	if tenant.Port != "" {
+		cfg.Port = tenant.Port
+	}
+	if tenant.Schema != "" {
+		cfg.Schema = tenant.Schema
+	}
+	if tenant.DBName != "" {
+		cfg.DBName = tenant.DBName
+	}
+	if tenant.Username != "" {
+		cfg.Username = tenant.Username
+	}
+	if tenant.Password != "" {
+		cfg.Password = tenant.Password
+	}
+	if tenant.SessionName != "" {
+		cfg.SessionName = tenant.SessionName
+	}
+	if tenant.ConnectTimeOut > 0 {
+		cfg.ConnectTimeOut = tenant.ConnectTimeOut
+	}
+	if tenant.MaxOpenConn > 0 {
+		cfg.MaxOpenConn = tenant.MaxOpenConn
+	}
+	if tenant.MaxIdleConn > 0 {
+		cfg.MaxIdleConn = tenant.MaxIdleConn
+	}
+	if len(tenant.ReadReplicas) > 0 {
+		cfg.ReadReplicas = tenant.ReadReplicas
+	}
+	if tenant.QueryTimeout > 0 {
+		cfg.QueryTimeout = tenant.QueryTimeout
+	}
+	if tenant.StatementTimeout > 0 {
+		cfg.StatementTimeout = tenant.StatementTimeout
+	}
+	if tenant.SSLMode != "" {
+		cfg.SSLMode = tenant.SSLMode
+	}
+	if tenant.SSLRootCert != "" {
+		cfg.SSLRootCert = tenant.SSLRootCert
+	}
+	if tenant.SSLCert != "" {
+		cfg.SSLCert = tenant.SSLCert
+	}
+	if tenant.SSLKey != "" {
+		cfg.SSLKey = tenant.SSLKey
+	}
+	if len(tenant.Params) > 0 {
+		//tenant params override the base ones, the base map is copied so tenants never share it
+		params := make(map[string]string, len(base.Params)+len(tenant.Params))
+		for key, v := range base.Params {
+			params[key] = v
+		}
+		for key, v := range tenant.Params {
+			params[key] = v
+		}
+		cfg.Params = params
+	}
+	return cfg
+}
+
+// NewStaticTenantResolver resolve tenants from a fixed map keyed by tenant
+func NewStaticTenantResolver(tenants map[string]DBConfiguration) TenantResolver {
+	return staticTenantResolver{tenants: tenants}
+}
+
+type staticTenantResolver struct {
+	tenants map[string]DBConfiguration
+}
+
+func (r staticTenantResolver) Tenants(ctx context.Context) ([]string, error) {
+	tenants := make([]string, 0, len(r.tenants))
+	for key := range r.tenants {
+		tenants = append(tenants, key)
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+func (r staticTenantResolver) Resolve(ctx context.Context, tenant string) (DBConfiguration, error) {
+	cfg, ok := r.tenants[tenant]
+	if !ok {
+		return DBConfiguration{}, fmt.Errorf("tenant %s not found", tenant)
+	}
+	return cfg, nil
+}
+
+/*
+NewJSONFileTenantResolver resolve tenants from a json file, the file is read on every resolve
+so wrap it with NewCachedTenantResolver. example :
+
+	{
+		"tenant1": {"host": "10.0.0.1", "db_name": "tenant1", "username": "u1", "password": "p1"}
+	}
+*/
+func NewJSONFileTenantResolver(path string) TenantResolver {
+	return jsonFileTenantResolver{path: path}
+}
+
+type jsonFileTenantResolver struct {
+	path string
+}
+
+func (r jsonFileTenantResolver) Resolve(ctx context.Context, tenant string) (DBConfiguration, error) {
+	tenants, err := r.load()
+	if err != nil {
+		return DBConfiguration{}, err
+	}
+
+	rec, ok := tenants[tenant]
+	if !ok {
+		return DBConfiguration{}, fmt.Errorf("tenant %s not found", tenant)
+	}
+	return rec.Config(), nil
+}
+
+func (r jsonFileTenantResolver) Tenants(ctx context.Context) ([]string, error) {
+	records, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := make([]string, 0, len(records))
+	for key := range records {
+		tenants = append(tenants, key)
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+func (r jsonFileTenantResolver) load() (map[string]TenantRecord, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tenant file: %w", err)
+	}
+
+	var tenants map[string]TenantRecord
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("failed to parse tenant file: %w", err)
+	}
+	return tenants, nil
+}
+
+// NewTableTenantResolver resolve tenants from a control plane table in the master database,
+// rows are read with the columns of TenantRecord. table defaults to "tenants"
+func NewTableTenantResolver(master *gorm.DB, table string) TenantResolver {
+	if table == "" {
+		table = "tenants"
+	}
+	return tableTenantResolver{db: master, table: table}
+}
+
+type tableTenantResolver struct {
+	db    *gorm.DB
+	table string
+}
+
+func (r tableTenantResolver) Resolve(ctx context.Context, tenant string) (DBConfiguration, error) {
+	var rec TenantRecord
+	err := r.db.WithContext(ctx).Table(r.table).Where("tenant_key = ?", tenant).Take(&rec).Error
+	if err != nil {
+		return DBConfiguration{}, fmt.Errorf("tenant %s: %w", tenant, err)
+	}
+	return rec.Config(), nil
+}
+
+func (r tableTenantResolver) Tenants(ctx context.Context) ([]string, error) {
+	var tenants []string
+	err := r.db.WithContext(ctx).Table(r.table).Order("tenant_key").Pluck("tenant_key", &tenants).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants: %w", err)
+	}
+	return tenants, nil
+}
+
+// tenantLookupTimeout bound a lookup of the cached resolver, it no longer ends with the ctx of the caller
+const tenantLookupTimeout = 30 * time.Second
+
+// NewCachedTenantResolver cache the results of resolver for ttl, errors are not cached.
+// Concurrent lookups of the same tenant share one call to resolver and expired entries are dropped
+func NewCachedTenantResolver(resolver TenantResolver, ttl time.Duration) TenantResolver {
+	return &cachedTenantResolver{
+		resolver: resolver,
+		ttl:      ttl,
+		entries:  make(map[string]cachedTenant),
+		inflight: make(map[string]*tenantLookup),
+	}
+}
+
+type cachedTenant struct {
+	cfg     DBConfiguration
+	expires time.Time
+}
+
+// tenantLookup is a resolve in progress, done is closed once cfg and err are set
+type tenantLookup struct {
+	done chan struct{}
+	cfg  DBConfiguration
+	err  error
+}
+
+type cachedTenantResolver struct {
+	resolver  TenantResolver
+	ttl       time.Duration
+	mu        sync.Mutex
+	entries   map[string]cachedTenant
+	inflight  map[string]*tenantLookup
+	nextSweep time.Time
+}
+
+func (r *cachedTenantResolver) Resolve(ctx context.Context, tenant string) (DBConfiguration, error) {
+	r.mu.Lock()
+	if entry, ok := r.entries[tenant]; ok && time.Now().Before(entry.expires) {
+		r.mu.Unlock()
+		return entry.cfg, nil
+	}
+
+	lookup, ok := r.inflight[tenant]
+	if !ok {
+		lookup = &tenantLookup{done: make(chan struct{})}
+		r.inflight[tenant] = lookup
+		go r.lookup(context.WithoutCancel(ctx), tenant, lookup)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-lookup.done:
+		return lookup.cfg, lookup.err
+	case <-ctx.Done():
+		return DBConfiguration{}, ctx.Err()
+	}
+}
+
+// lookup resolve tenant for every waiter, detached from the ctx of the first caller
+// so its cancellation does not fail the others
+func (r *cachedTenantResolver) lookup(ctx context.Context, tenant string, lookup *tenantLookup) {
+	ctx, cancel := context.WithTimeout(ctx, tenantLookupTimeout)
+	defer cancel()
+
+	lookup.cfg, lookup.err = r.resolver.Resolve(ctx, tenant)
+
+	r.mu.Lock()
+	delete(r.inflight, tenant)
+	now := time.Now()
+	if lookup.err == nil {
+		r.entries[tenant] = cachedTenant{cfg: lookup.cfg, expires: now.Add(r.ttl)}
+	} else {
+		delete(r.entries, tenant)
+	}
+	r.sweep(now)
+	r.mu.Unlock()
+	close(lookup.done)
+}
+
+// sweep drop the expired entries, at most once per ttl so a lookup stays cheap. r.mu must be held
+func (r *cachedTenantResolver) sweep(now time.Time) {
+	if now.Before(r.nextSweep) {
+		return
+	}
+	r.nextSweep = now.Add(r.ttl)
+
+	for tenant, entry := range r.entries {
+		if !now.Before(entry.expires) {
+			delete(r.entries, tenant)
+		}
+	}
+}
+
+// Tenants is not cached, it is delegated to the wrapped resolver
+func (r *cachedTenantResolver) Tenants(ctx context.Context) ([]string, error) {
+	lister, ok := r.resolver.(TenantLister)
+	if !ok {
+		return nil, fmt.Errorf("resolver does not list tenants")
+	}
+	return lister.Tenants(ctx)
+}
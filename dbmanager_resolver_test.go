@@ -0,0 +1,113 @@
+package utilities
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingResolver struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, tenant string) (DBConfiguration, error) {
+	r.calls.Add(1)
+	if r.release != nil {
+		<-r.release
+	}
+	return DBConfiguration{DBName: tenant}, nil
+}
+
+func TestCachedTenantResolverSharesLookups(t *testing.T) {
+	backing := &countingResolver{release: make(chan struct{})}
+	resolver := NewCachedTenantResolver(backing, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg, err := resolver.Resolve(context.Background(), "t1")
+			assert.NoError(t, err)
+			assert.Equal(t, "t1", cfg.DBName)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(backing.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), backing.calls.Load())
+}
+
+func TestCachedTenantResolverDropsExpired(t *testing.T) {
+	backing := &countingResolver{}
+	resolver := NewCachedTenantResolver(backing, 10*time.Millisecond).(*cachedTenantResolver)
+
+	for _, tenant := range []string{"t1", "t2", "t3"} {
+		_, err := resolver.Resolve(context.Background(), tenant)
+		require.NoError(t, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	_, err := resolver.Resolve(context.Background(), "t4")
+	require.NoError(t, err)
+
+	assert.Len(t, resolver.entries, 1)
+	assert.Equal(t, int32(4), backing.calls.Load())
+}
+
+func TestTenantRecordConfig(t *testing.T) {
+	rec := TenantRecord{
+		Host:             "10.0.0.1",
+		ReadReplicas:     "10.0.0.2:5432, 10.0.0.3",
+		SSLMode:          SSLVerifyFull,
+		SSLRootCert:      "/ca.pem",
+		StatementTimeout: 5000,
+		QueryTimeout:     2000,
+		Params:           "target_session_attrs=read-write",
+	}
+
+	cfg := rec.Config()
+	assert.Equal(t, []string{"10.0.0.2:5432", "10.0.0.3"}, cfg.ReadReplicas)
+	assert.Equal(t, SSLVerifyFull, cfg.SSLMode)
+	assert.Equal(t, "/ca.pem", cfg.SSLRootCert)
+	assert.Equal(t, 5000, cfg.StatementTimeout)
+	assert.Equal(t, 2000, cfg.QueryTimeout)
+	assert.Equal(t, map[string]string{"target_session_attrs": "read-write"}, cfg.Params)
+}
+
+func TestCachedTenantResolverIgnoresCancelledCaller(t *testing.T) {
+	backing := &countingResolver{release: make(chan struct{})}
+	resolver := NewCachedTenantResolver(backing, time.Minute)
+
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := resolver.Resolve(first, "t1")
+		firstErr <- err
+	}()
+
+	for backing.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan DBConfiguration)
+	go func() {
+		cfg, err := resolver.Resolve(context.Background(), "t1")
+		assert.NoError(t, err)
+		second <- cfg
+	}()
+
+	cancel()
+	assert.ErrorIs(t, <-firstErr, context.Canceled)
+
+	close(backing.release)
+	assert.Equal(t, "t1", (<-second).DBName)
+	assert.Equal(t, int32(1), backing.calls.Load())
+}
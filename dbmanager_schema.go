@@ -0,0 +1,107 @@
+package utilities
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const tenantSchemaKey = "utilities:tenant_schema"
+
+// ErrUnqualifiedTable is returned in schema per tenant mode for a statement on a table without schema,
+// it would run in the search_path of the shared pool instead of the tenant schema
+var ErrUnqualifiedTable = errors.New("table is not qualified with a schema")
+
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validIdentifier(name string) bool {
+	return identifierPattern.MatchString(name)
+}
+
+// TenantSchema return the schema of a db returned by a DBManager in schema per tenant mode, empty otherwise
+func TenantSchema(db *gorm.DB) string {
+	v, ok := db.Get(tenantSchemaKey)
+	if !ok {
+		return ""
+	}
+	return v.(string)
+}
+
+// TenantTable qualify table with the tenant schema of db, use it with db.Table and models implementing TableName
+// because GORM does not apply the tenant table prefix to them
+func TenantTable(db *gorm.DB, table string) string {
+	if schema := TenantSchema(db); schema != "" {
+		return schema + "." + table
+	}
+	return table
+}
+
+/*
+WithTenantSearchPath run fn inside a transaction scoped to the tenant schema with SET LOCAL search_path,
+use it for raw sql which is not prefixed by the tenant naming strategy.
+The setting ends with the transaction so the pooled connection is returned clean.
+
+	err := WithTenantSearchPath(db, func(tx *gorm.DB) error {
+		return tx.Exec("UPDATE users SET active = ?", true).Error
+	})
+*/
+func WithTenantSearchPath(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	schema := TenantSchema(db)
+	if schema == "" {
+		return fmt.Errorf("db is not scoped to a tenant schema")
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(fmt.Sprintf(`SET LOCAL search_path TO "%s"`, schema)).Error; err != nil {
+			return fmt.Errorf("failed to set search_path: %w", err)
+		}
+		return fn(tx)
+	})
+}
+
+// schemaGuard fail statements whose table is not schema qualified, GORM skips the tenant table prefix
+// for models implementing TableName and for db.Table. Raw sql is not checked, see WithTenantSearchPath
+type schemaGuard struct{}
+
+func (schemaGuard) Name() string {
+	return "utilities:schema_guard"
+}
+
+func (g schemaGuard) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("*").Register("utilities:schema_guard_create", g.check),
+		cb.Query().Before("*").Register("utilities:schema_guard_query", g.check),
+		cb.Update().Before("*").Register("utilities:schema_guard_update", g.check),
+		cb.Delete().Before("*").Register("utilities:schema_guard_delete", g.check),
+		cb.Row().Before("*").Register("utilities:schema_guard_row", g.check),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (schemaGuard) check(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.SQL.Len() > 0 {
+		return
+	}
+
+	//db.Table keeps the written table in TableExpr, Table only holds its last part
+	table := stmt.Table
+	if stmt.TableExpr != nil {
+		table, _, _ = strings.Cut(strings.TrimSpace(stmt.TableExpr.SQL), " ")
+		if strings.HasPrefix(table, "(") {
+			//subqueries go through the callbacks on their own
+			return
+		}
+	}
+	if table != "" && !strings.Contains(table, ".") {
+		db.AddError(fmt.Errorf("%w: %s, use TenantTable", ErrUnqualifiedTable, table))
+	}
+}
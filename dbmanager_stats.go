@@ -0,0 +1,173 @@
+package utilities
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sharedPoolKey is the Stats key of the pool shared by all tenants in schema per tenant mode
+const sharedPoolKey = "_shared"
+
+type TenantPoolSnapshot struct {
+	Tenant             string    `json:"tenant"`
+	MaxOpenConnections int       `json:"max_open_connections"`
+	OpenConnections    int       `json:"open_connections"`
+	InUse              int       `json:"in_use"`
+	Idle               int       `json:"idle"`
+	WaitCount          int64     `json:"wait_count"`
+	WaitDurationMs     int64     `json:"wait_duration_ms"`
+	MaxIdleClosed      int64     `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64     `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64     `json:"max_lifetime_closed"`
+	Saturation         float64   `json:"saturation"` // in use / max open, 0 when unlimited
+	OpenedAt           time.Time `json:"opened_at,omitempty"`
+	LastUsed           time.Time `json:"last_used,omitempty"`
+}
+
+type DBManagerSnapshot struct {
+	Pools         []TenantPoolSnapshot `json:"pools"`
+	OpenTenants   int                  `json:"open_tenants"`
+	DrainingPools int                  `json:"draining_pools"`
+	OpenedTotal   int64                `json:"opened_total"`
+	EvictedTotal  int64                `json:"evicted_total"`
+}
+
+func newTenantPoolSnapshot(tenant string, st sql.DBStats) TenantPoolSnapshot {
+	snap := TenantPoolSnapshot{
+		Tenant:             tenant,
+		MaxOpenConnections: st.MaxOpenConnections,
+		OpenConnections:    st.OpenConnections,
+		InUse:              st.InUse,
+		Idle:               st.Idle,
+		WaitCount:          st.WaitCount,
+		WaitDurationMs:     st.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      st.MaxIdleClosed,
+		MaxIdleTimeClosed:  st.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  st.MaxLifetimeClosed,
+	}
+	if st.MaxOpenConnections > 0 {
+		snap.Saturation = float64(st.InUse) / float64(st.MaxOpenConnections)
+	}
+	return snap
+}
+
+// Stats of every open tenant pool, in schema per tenant mode the shared pool is reported once under "_shared".
+// Read replica pools are reported as "<tenant>@<host:port>"
+func (m *dbmanager) Stats() map[string]sql.DBStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := make(map[string]sql.DBStats, len(m.connections))
+	if m.shared != nil {
+		stats[sharedPoolKey] = m.shared.Stats()
+		if m.sharedRepl != nil {
+			m.sharedRepl.stats(sharedPoolKey, stats)
+		}
+		return stats
+	}
+
+	for key, conn := range m.connections {
+		sqlDB, err := conn.db.DB()
+		if err != nil {
+			continue
+		}
+		stats[key] = sqlDB.Stats()
+		if conn.replicas != nil {
+			conn.replicas.stats(key, stats)
+		}
+	}
+	return stats
+}
+
+func (m *dbmanager) Snapshot() DBManagerSnapshot {
+	stats := m.Stats()
+
+	m.mu.RLock()
+	snap := DBManagerSnapshot{
+		OpenTenants:   len(m.connections),
+		DrainingPools: len(m.draining),
+		OpenedTotal:   m.opened,
+		EvictedTotal:  m.evicted,
+	}
+	for key, st := range stats {
+		pool := newTenantPoolSnapshot(key, st)
+		if conn, ok := m.connections[key]; ok {
+			pool.OpenedAt = conn.openedAt
+			pool.LastUsed = conn.used()
+		}
+		snap.Pools = append(snap.Pools, pool)
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(snap.Pools, func(i, j int) bool { return snap.Pools[i].Tenant < snap.Pools[j].Tenant })
+	return snap
+}
+
+func (m *dbmanager) Ping(ctx context.Context) error {
+	if contextString(ctx, "dbname") != "" {
+		db, err := m.DB(ctx)
+		if err != nil {
+			return err
+		}
+
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.PingContext(ctx)
+	}
+
+	pools := map[string]*sql.DB{}
+	m.mu.RLock()
+	if m.shared != nil {
+		pools[sharedPoolKey] = m.shared
+	} else {
+		for key, conn := range m.connections {
+			if sqlDB, err := conn.db.DB(); err == nil {
+				pools[key] = sqlDB
+			}
+		}
+	}
+	m.mu.RUnlock()
+
+	var errs []error
+	for key, sqlDB := range pools {
+		if err := sqlDB.PingContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", key, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("errors pinging connections: %v", errs)
+	}
+	return nil
+}
+
+// DBStatsHandler export the manager snapshot as json
+func DBStatsHandler(dbm DBManager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dbm.Snapshot())
+	}
+}
+
+// DBReadinessHandler respond 503 when any open pool fails to answer a ping within timeout
+func DBReadinessHandler(dbm DBManager, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := dbm.Ping(ctx); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"status": "unavailable", "error": err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+	}
+}
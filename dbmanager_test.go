@@ -0,0 +1,43 @@
+package utilities
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBManagerEvictsLeastRecentlyUsed(t *testing.T) {
+	m := &dbmanager{connections: map[string]*tenantConn{}, config: DBConfiguration{MaxTenantPools: 2}}
+	db := dryRunDB(t, Postgresql)
+
+	m.register("t1", db, nil)
+	time.Sleep(time.Millisecond)
+	m.register("t2", db, nil)
+	time.Sleep(time.Millisecond)
+
+	_, err := m.DB(TenantContext(context.Background(), "t1", ""))
+	require.NoError(t, err)
+
+	m.register("t3", db, nil)
+	assert.Contains(t, m.connections, "t1")
+	assert.Contains(t, m.connections, "t3")
+	assert.NotContains(t, m.connections, "t2")
+	require.Len(t, m.draining, 1)
+	assert.Equal(t, "t2", m.draining[0].key)
+}
+
+func TestDBManagerEvictsIdle(t *testing.T) {
+	m := &dbmanager{connections: map[string]*tenantConn{}, config: DBConfiguration{TenantIdleTimeout: 60}}
+	db := dryRunDB(t, Postgresql)
+
+	m.register("idle", db, nil)
+	m.register("busy", db, nil)
+	m.connections["idle"].lastUsed.Store(time.Now().Add(-2 * time.Minute).UnixNano())
+
+	m.evictIdle()
+	assert.NotContains(t, m.connections, "idle")
+	assert.Contains(t, m.connections, "busy")
+}
@@ -0,0 +1,155 @@
+package utilities
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type TxOptions struct {
+	Isolation sql.IsolationLevel
+	ReadOnly  bool
+	//number of retries after the first attempt when the transaction fails with a serialization failure or deadlock
+	MaxRetries int
+	//backoff before the first retry, doubled on every retry with full jitter. default 50ms
+	BaseBackoff time.Duration
+	//upper bound of the backoff. default 2s
+	MaxBackoff time.Duration
+}
+
+type txStateKey struct{}
+
+type txState struct {
+	tx         *gorm.DB
+	savepoints int
+	afterHooks []func()
+}
+
+/*
+WithTx run fn inside a transaction of the tenant database of ctx.
+The transaction is committed when fn returns nil and rolled back otherwise, serialization failures
+and deadlocks are retried according to opts. fn may run more than once so it must not have side effects
+outside the transaction, register them with AfterCommit instead.
+
+Calling WithTx again with tx.Statement.Context creates a savepoint inside the running transaction,
+retries are only done by the outermost call.
+
+	err := WithTx(dbm, ctx, &TxOptions{Isolation: sql.LevelSerializable, MaxRetries: 3}, func(tx *gorm.DB) error {
+		AfterCommit(tx, func() { publishEvent() })
+		return tx.Create(&order).Error
+	})
+*/
+func WithTx(dbm DBManager, ctx context.Context, opts *TxOptions, fn func(tx *gorm.DB) error) error {
+	if opts == nil {
+		opts = &TxOptions{}
+	}
+
+	if state, ok := ctx.Value(txStateKey{}).(*txState); ok {
+		return withSavepoint(ctx, state, fn)
+	}
+
+	db, err := dbm.DB(ctx)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		state := &txState{}
+		err := runTx(db, context.WithValue(ctx, txStateKey{}, state), state, opts, fn)
+		if err == nil {
+			for _, hook := range state.afterHooks {
+				hook()
+			}
+			return nil
+		}
+
+		if attempt >= opts.MaxRetries || !IsRetryableTxError(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ctx.Err(), err)
+		case <-time.After(txBackoff(opts, attempt)):
+		}
+	}
+}
+
+func runTx(db *gorm.DB, ctx context.Context, state *txState, opts *TxOptions, fn func(tx *gorm.DB) error) (err error) {
+	tx := db.WithContext(ctx).Begin(&sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if tx.Error != nil {
+		return fmt.Errorf("failed to begin transaction: %w", tx.Error)
+	}
+	state.tx = tx
+
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = fn(tx)
+	panicked = false
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func withSavepoint(ctx context.Context, state *txState, fn func(tx *gorm.DB) error) (err error) {
+	state.savepoints++
+	name := fmt.Sprintf("sp_%d", state.savepoints)
+	hooks := len(state.afterHooks)
+
+	tx := state.tx.WithContext(ctx)
+	if err := tx.SavePoint(name).Error; err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", err)
+	}
+
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			tx.RollbackTo(name)
+			//hooks registered inside a rolled back savepoint must not run
+			state.afterHooks = state.afterHooks[:hooks]
+		}
+	}()
+
+	err = fn(tx)
+	panicked = false
+	return err
+}
+
+func txBackoff(opts *TxOptions, attempt int) time.Duration {
+	base := opts.BaseBackoff
+	if base <= 0 {
+		base = 50 * time.Millisecond
+	}
+	limit := opts.MaxBackoff
+	if limit <= 0 {
+		limit = 2 * time.Second
+	}
+
+	backoff := base << attempt
+	if backoff <= 0 || backoff > limit {
+		backoff = limit
+	}
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+// AfterCommit register fn to run once the outermost transaction of tx has committed
+func AfterCommit(tx *gorm.DB, fn func()) {
+	state, ok := tx.Statement.Context.Value(txStateKey{}).(*txState)
+	if !ok {
+		//not inside WithTx, nothing to wait for
+		fn()
+		return
+	}
+	state.afterHooks = append(state.afterHooks, fn)
+}
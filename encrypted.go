@@ -0,0 +1,300 @@
+package utilities
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrUnknownEncryptionKey is returned when a value was encrypted with a key id missing from the key ring
+	ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+	// ErrMalformedCiphertext is returned when a stored value is not [key id]:[base64]
+	ErrMalformedCiphertext = errors.New("malformed ciphertext")
+)
+
+// KeyRing hold the AES-256 keys by id, values are encrypted with the active key and decrypted with the key they name
+type KeyRing struct {
+	active   string
+	keys     map[string]cipher.AEAD
+	blindKey []byte
+}
+
+// NewKeyRing build a key ring, every key must be 32 bytes. blindKey may be nil when blind indexes are not used
+func NewKeyRing(active string, keys map[string][]byte, blindKey []byte) (*KeyRing, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the key ring", active)
+	}
+
+	kr := &KeyRing{active: active, keys: map[string]cipher.AEAD{}, blindKey: blindKey}
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 bytes, got %d", id, len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if kr.keys[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+/*
+LoadKeyRingFromEnv read the key ring from env. example :
+
+	ENCRYPTION_KEYS=2024:base64key,2025:base64key
+	ENCRYPTION_ACTIVE_KEY=2025
+	BLIND_INDEX_KEY=base64key
+
+to rotate, add a new key, make it active and re-save the rows, old keys stay until no row uses them.
+ENCRYPTION_ACTIVE_KEY defaults to the last key of the list
+*/
+func LoadKeyRingFromEnv() (*KeyRing, error) {
+	entries := envList("ENCRYPTION_KEYS")
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("ENCRYPTION_KEYS is not set")
+	}
+
+	keys := map[string][]byte{}
+	active := EnvString("ENCRYPTION_ACTIVE_KEY")
+	for i, entry := range entries {
+		//the entry holds the key, keep it out of the error
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("encryption key %d must be [id]:[base64 key]", i+1)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode encryption key %s: %w", id, err)
+		}
+		keys[id] = key
+	}
+	if active == "" {
+		active, _, _ = strings.Cut(entries[len(entries)-1], ":")
+	}
+
+	var blindKey []byte
+	if encoded := EnvString("BLIND_INDEX_KEY"); encoded != "" {
+		var err error
+		if blindKey, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("failed to decode blind index key: %w", err)
+		}
+	}
+
+	return NewKeyRing(active, keys, blindKey)
+}
+
+// Encrypt seal plain with the active key, the key id is kept in front of the ciphertext
+func (k *KeyRing) Encrypt(plain []byte) (string, error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	//the key id is authenticated so a value cannot be relabelled to another key
+	sealed := aead.Seal(nonce, nonce, plain, []byte(k.active))
+	return k.active + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *KeyRing) Decrypt(value string) ([]byte, error) {
+	id, encoded, ok := strings.Cut(value, ":")
+	if !ok {
+		return nil, ErrMalformedCiphertext
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, id)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plain, nil
+}
+
+// BlindIndex return a deterministic HMAC-SHA256 of value, store it in a separate indexed column to look rows up by equality
+func (k *KeyRing) BlindIndex(value string) (string, error) {
+	if len(k.blindKey) == 0 {
+		return "", fmt.Errorf("blind index key is not set")
+	}
+	mac := hmac.New(sha256.New, k.blindKey)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+var (
+	keyRingMu  sync.RWMutex
+	keyRing    *KeyRing
+	keyRingErr error
+	keyRingEnv sync.Once
+)
+
+// SetKeyRing replace the key ring used by EncryptedString and EncryptedJSON, by default it is loaded from env
+func SetKeyRing(kr *KeyRing) {
+	keyRingEnv.Do(func() {})
+	keyRingMu.Lock()
+	keyRing, keyRingErr = kr, nil
+	keyRingMu.Unlock()
+}
+
+func defaultKeyRing() (*KeyRing, error) {
+	keyRingEnv.Do(func() {
+		kr, err := LoadKeyRingFromEnv()
+		keyRingMu.Lock()
+		keyRing, keyRingErr = kr, err
+		keyRingMu.Unlock()
+	})
+
+	keyRingMu.RLock()
+	defer keyRingMu.RUnlock()
+	return keyRing, keyRingErr
+}
+
+// BlindIndex compute the blind index of value with the default key ring
+func BlindIndex(value string) (string, error) {
+	kr, err := defaultKeyRing()
+	if err != nil {
+		return "", err
+	}
+	return kr.BlindIndex(value)
+}
+
+/*
+EncryptedString is a string stored encrypted with AES-256-GCM. Equality lookups go through a blind index column :
+
+	type Customer struct {
+		ID       uint
+		NIK      EncryptedString
+		NIKIndex string `gorm:"size:64;index"`
+	}
+
+	func (c *Customer) BeforeSave(tx *gorm.DB) (err error) {
+		c.NIKIndex, err = BlindIndex(string(c.NIK))
+		return err
+	}
+
+	idx, _ := BlindIndex(nik)
+	db.Where("nik_index = ?", idx).First(&customer)
+*/
+type EncryptedString string
+
+// encryptedColumn mark the encrypted types, the audit trail never records their plaintext
+type encryptedColumn interface {
+	encryptedColumn()
+}
+
+func (EncryptedString) encryptedColumn()  {}
+func (EncryptedJSON[T]) encryptedColumn() {}
+
+func (EncryptedString) GormDataType() string {
+	return "text"
+}
+
+func (s EncryptedString) Value() (driver.Value, error) {
+	kr, err := defaultKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	return kr.Encrypt([]byte(s))
+}
+
+func (s *EncryptedString) Scan(src any) error {
+	if src == nil {
+		*s = ""
+		return nil
+	}
+
+	plain, err := decryptColumn(src)
+	if err != nil {
+		return err
+	}
+	*s = EncryptedString(plain)
+	return nil
+}
+
+// EncryptedJSON is a value of T stored as encrypted json
+type EncryptedJSON[T any] struct {
+	Data T
+}
+
+func (EncryptedJSON[T]) GormDataType() string {
+	return "text"
+}
+
+func (e EncryptedJSON[T]) Value() (driver.Value, error) {
+	plain, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	kr, err := defaultKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	return kr.Encrypt(plain)
+}
+
+func (e *EncryptedJSON[T]) Scan(src any) error {
+	var zero T
+	e.Data = zero
+	if src == nil {
+		return nil
+	}
+
+	plain, err := decryptColumn(src)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, &e.Data)
+}
+
+func (e EncryptedJSON[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Data)
+}
+
+func (e *EncryptedJSON[T]) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &e.Data)
+}
+
+func decryptColumn(src any) ([]byte, error) {
+	var value string
+	switch v := src.(type) {
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return nil, fmt.Errorf("cannot scan %T into an encrypted value", src)
+	}
+
+	kr, err := defaultKeyRing()
+	if err != nil {
+		return nil, err
+	}
+	return kr.Decrypt(value)
+}
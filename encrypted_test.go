@@ -0,0 +1,120 @@
+package utilities
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestKeyRingRoundTrip(t *testing.T) {
+	kr, err := NewKeyRing("k1", map[string][]byte{"k1": testKey(1)}, testKey(9))
+	require.NoError(t, err)
+
+	for _, plain := range []string{"", "3171234567890001", "unicode ✓ value"} {
+		sealed, err := kr.Encrypt([]byte(plain))
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(sealed, "k1:"))
+
+		opened, err := kr.Decrypt(sealed)
+		require.NoError(t, err)
+		assert.Equal(t, plain, string(opened))
+	}
+
+	a, _ := kr.Encrypt([]byte("same"))
+	b, _ := kr.Encrypt([]byte("same"))
+	assert.NotEqual(t, a, b, "nonces must differ")
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	old, err := NewKeyRing("2024", map[string][]byte{"2024": testKey(1)}, nil)
+	require.NoError(t, err)
+	sealedOld, err := old.Encrypt([]byte("secret"))
+	require.NoError(t, err)
+
+	rotated, err := NewKeyRing("2025", map[string][]byte{"2024": testKey(1), "2025": testKey(2)}, nil)
+	require.NoError(t, err)
+
+	opened, err := rotated.Decrypt(sealedOld)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", string(opened))
+
+	sealedNew, err := rotated.Encrypt([]byte("secret"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealedNew, "2025:"))
+
+	_, err = old.Decrypt(sealedNew)
+	assert.ErrorIs(t, err, ErrUnknownEncryptionKey)
+}
+
+func TestKeyRingRejects(t *testing.T) {
+	kr, err := NewKeyRing("k1", map[string][]byte{"k1": testKey(1), "k2": testKey(2)}, nil)
+	require.NoError(t, err)
+	sealed, err := kr.Encrypt([]byte("secret"))
+	require.NoError(t, err)
+	_, payload, _ := strings.Cut(sealed, ":")
+
+	tests := []struct {
+		name  string
+		value string
+		is    error
+	}{
+		{"no key id", "abc", ErrMalformedCiphertext},
+		{"bad base64", "k1:!!!", ErrMalformedCiphertext},
+		{"too short", "k1:AAAA", ErrMalformedCiphertext},
+		{"unknown key", "k9:" + payload, ErrUnknownEncryptionKey},
+		{"relabelled key", "k2:" + payload, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := kr.Decrypt(tt.value)
+			require.Error(t, err)
+			if tt.is != nil {
+				assert.ErrorIs(t, err, tt.is)
+			}
+		})
+	}
+
+	_, err = kr.BlindIndex("x")
+	assert.Error(t, err, "blind index needs a key")
+}
+
+func TestNewKeyRingValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		active string
+		keys   map[string][]byte
+	}{
+		{"active missing", "k2", map[string][]byte{"k1": testKey(1)}},
+		{"short key", "k1", map[string][]byte{"k1": []byte("short")}},
+		{"colon in id", "a:b", map[string][]byte{"a:b": testKey(1)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyRing(tt.active, tt.keys, nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	kr, err := NewKeyRing("k1", map[string][]byte{"k1": testKey(1)}, testKey(9))
+	require.NoError(t, err)
+
+	a, err := kr.BlindIndex("3171234567890001")
+	require.NoError(t, err)
+	b, _ := kr.BlindIndex("3171234567890001")
+	c, _ := kr.BlindIndex("3171234567890002")
+
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+	assert.Len(t, a, 64)
+}
@@ -0,0 +1,356 @@
+package utilities
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/mock"
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+type MockFixtures struct {
+	mock.Mock
+}
+
+func (m *MockFixtures) Load(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func (m *MockFixtures) Truncate(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func (m *MockFixtures) Row(table, name string) (map[string]any, bool) {
+	args := m.Called(table, name)
+	if v := args.Get(0); v != nil {
+		return v.(map[string]any), args.Bool(1)
+	}
+	return nil, args.Bool(1)
+}
+
+// fixtureTemplatePattern match a whole value like {{now}}, {{now -24h}}, {{uuid}} or {{ref orgs.acme.id}}
+var fixtureTemplatePattern = regexp.MustCompile(`^\{\{\s*(\w+)(?:\s+([^}]*?))?\s*\}\}$`)
+
+type Fixtures interface {
+	// Load empty the fixture tables of the tenant database of ctx and insert the fixtures, in one transaction
+	Load(ctx context.Context) error
+	// Truncate empty the fixture tables of the tenant database of ctx
+	Truncate(ctx context.Context) error
+	// Row return the values inserted by the last Load for a fixture, with its templates rendered
+	Row(table, name string) (map[string]any, bool)
+}
+
+type fixtureRow struct {
+	table  string
+	name   string
+	values map[string]any
+	deps   []string
+}
+
+func (r *fixtureRow) key() string {
+	return r.table + "." + r.name
+}
+
+/*
+NewFixtures read the fixtures in dir of fsys, one file per table named [table].yml, [table].yaml or [table].json.
+A file maps fixture names to rows, a value may be one of these templates :
+
+	{{now}}                    the load time, {{now -24h}} or {{now +30m}} shifts it
+	{{uuid}}                   a new random uuid
+	{{ref orgs.acme}}          the id of fixture acme of orgs.yml, {{ref orgs.acme.code}} for another column
+
+Rows are inserted after the rows they reference, referenced columns must be set in the fixture file.
+Auto increment sequences are not moved past explicit ids, leave ids out of rows other tests insert into.
+
+	# users.yml
+	alice:
+	  id: 1
+	  org_id: "{{ref orgs.acme}}"
+	  name: Alice
+	  created_at: "{{now}}"
+
+	fixtures, err := NewFixtures(dbm, os.DirFS("testdata"), "fixtures")
+	err = fixtures.Load(TenantContext(ctx, "tenant_test", ""))
+*/
+func NewFixtures(dbm DBManager, fsys fs.FS, dir string) (Fixtures, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture dir: %w", err)
+	}
+
+	f := &fixtures{dbm: dbm, rendered: map[string]map[string]any{}}
+	var rows []*fixtureRow
+	for _, entry := range entries {
+		ext := path.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yml" && ext != ".yaml" && ext != ".json") {
+			continue
+		}
+
+		table := strings.TrimSuffix(entry.Name(), ext)
+		if !validIdentifier(table) {
+			return nil, fmt.Errorf("invalid fixture table name %q", table)
+		}
+		f.tables = append(f.tables, table)
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fixture %s: %w", entry.Name(), err)
+		}
+		parsed, err := parseFixtureFile(content, ext == ".json")
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse fixture %s: %w", entry.Name(), err)
+		}
+
+		for name, values := range parsed {
+			row := &fixtureRow{table: table, name: name, values: values}
+			for _, v := range values {
+				if s, ok := v.(string); ok {
+					if m := fixtureTemplatePattern.FindStringSubmatch(s); m != nil && m[1] == "ref" {
+						target, _ := splitFixtureRef(m[2])
+						row.deps = append(row.deps, target)
+					}
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	if f.rows, err = sortFixtures(rows); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseFixtureFile(content []byte, isJSON bool) (map[string]map[string]any, error) {
+	parsed := map[string]map[string]any{}
+	if !isJSON {
+		return parsed, yaml.Unmarshal(content, &parsed)
+	}
+
+	//keep large ids exact
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.UseNumber()
+	if err := dec.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	for _, values := range parsed {
+		for col, v := range values {
+			if n, ok := v.(json.Number); ok {
+				if i, err := n.Int64(); err == nil {
+					values[col] = i
+				} else {
+					values[col], _ = n.Float64()
+				}
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// splitFixtureRef split table.fixture[.column] into the fixture key and the column, id by default
+func splitFixtureRef(ref string) (string, string) {
+	parts := strings.Split(strings.TrimSpace(ref), ".")
+	if len(parts) >= 3 {
+		return parts[0] + "." + parts[1], parts[2]
+	}
+	return strings.Join(parts, "."), "id"
+}
+
+// sortFixtures order rows so every row comes after the rows it references
+func sortFixtures(rows []*fixtureRow) ([]*fixtureRow, error) {
+	sort.Slice(rows, func(i, j int) bool { return rows[i].key() < rows[j].key() })
+
+	byKey := make(map[string]*fixtureRow, len(rows))
+	for _, row := range rows {
+		byKey[row.key()] = row
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	sorted := make([]*fixtureRow, 0, len(rows))
+
+	var visit func(row *fixtureRow, chain []string) error
+	visit = func(row *fixtureRow, chain []string) error {
+		key := row.key()
+		switch state[key] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("fixture reference cycle %s -> %s", strings.Join(chain, " -> "), key)
+		}
+
+		state[key] = visiting
+		for _, dep := range row.deps {
+			target, ok := byKey[dep]
+			if !ok {
+				return fmt.Errorf("fixture %s references unknown fixture %s", key, dep)
+			}
+			if err := visit(target, append(chain, key)); err != nil {
+				return err
+			}
+		}
+		state[key] = done
+		sorted = append(sorted, row)
+		return nil
+	}
+
+	for _, row := range rows {
+		if err := visit(row, nil); err != nil {
+			return nil, err
+		}
+	}
+	return sorted, nil
+}
+
+type fixtures struct {
+	dbm    DBManager
+	tables []string
+	rows   []*fixtureRow
+
+	mu       sync.RWMutex
+	rendered map[string]map[string]any
+}
+
+func (f *fixtures) Load(ctx context.Context) error {
+	db, err := f.dbm.DB(ForcePrimary(ctx))
+	if err != nil {
+		return err
+	}
+
+	rendered, err := f.render(time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := f.truncate(tx); err != nil {
+			return err
+		}
+
+		for _, row := range f.rows {
+			if err := tx.Table(TenantTable(tx, row.table)).Create(rendered[row.key()]).Error; err != nil {
+				return fmt.Errorf("failed to insert fixture %s: %w", row.key(), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	f.rendered = rendered
+	f.mu.Unlock()
+	return nil
+}
+
+// render resolve the templates of every row, rows are visited in dependency order so references are already rendered
+func (f *fixtures) render(now time.Time) (map[string]map[string]any, error) {
+	rendered := make(map[string]map[string]any, len(f.rows))
+	for _, row := range f.rows {
+		values := make(map[string]any, len(row.values))
+		for col, v := range row.values {
+			s, ok := v.(string)
+			m := fixtureTemplatePattern.FindStringSubmatch(s)
+			if !ok || m == nil {
+				values[col] = v
+				continue
+			}
+
+			switch m[1] {
+			case "now":
+				shift := time.Duration(0)
+				if arg := strings.ReplaceAll(m[2], " ", ""); arg != "" {
+					var err error
+					if shift, err = time.ParseDuration(arg); err != nil {
+						return nil, fmt.Errorf("fixture %s.%s: %w", row.key(), col, err)
+					}
+				}
+				values[col] = now.Add(shift)
+			case "uuid":
+				values[col] = uuid.NewString()
+			case "ref":
+				target, column := splitFixtureRef(m[2])
+				value, ok := rendered[target][column]
+				if !ok {
+					return nil, fmt.Errorf("fixture %s.%s references %s.%s which is not set", row.key(), col, target, column)
+				}
+				values[col] = value
+			default:
+				return nil, fmt.Errorf("fixture %s.%s has unknown template %s", row.key(), col, m[1])
+			}
+		}
+		rendered[row.key()] = values
+	}
+	return rendered, nil
+}
+
+func (f *fixtures) Truncate(ctx context.Context) error {
+	db, err := f.dbm.DB(ForcePrimary(ctx))
+	if err != nil {
+		return err
+	}
+	return db.Transaction(f.truncate)
+}
+
+func (f *fixtures) truncate(tx *gorm.DB) (err error) {
+	if len(f.tables) == 0 {
+		return nil
+	}
+
+	quoted := make([]string, len(f.tables))
+	for i, table := range f.tables {
+		quoted[i] = tx.Statement.Quote(TenantTable(tx, table))
+	}
+
+	if tx.Dialector.Name() == Postgresql {
+		if err := tx.Exec("TRUNCATE TABLE " + strings.Join(quoted, ", ") + " RESTART IDENTITY CASCADE").Error; err != nil {
+			return fmt.Errorf("failed to truncate fixtures: %w", err)
+		}
+		return nil
+	}
+
+	//TRUNCATE commits the transaction on mysql, delete instead with the foreign key checks off
+	if err := tx.Exec("SET FOREIGN_KEY_CHECKS = 0").Error; err != nil {
+		return err
+	}
+	defer func() {
+		//the setting outlives the transaction on the pooled session, restore it even when a delete failed
+		reset := tx.Session(&gorm.Session{NewDB: true, Context: context.WithoutCancel(tx.Statement.Context)}).
+			Exec("SET FOREIGN_KEY_CHECKS = 1")
+		if err == nil {
+			err = reset.Error
+		}
+	}()
+
+	for _, table := range quoted {
+		if err := tx.Exec("DELETE FROM " + table).Error; err != nil {
+			return fmt.Errorf("failed to truncate fixtures: %w", err)
+		}
+	}
+	return nil
+}
+
+func (f *fixtures) Row(table, name string) (map[string]any, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	row, ok := f.rendered[table+"."+name]
+	return row, ok
+}
@@ -0,0 +1,81 @@
+package utilities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSortFixtures(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    []*fixtureRow
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "references come first",
+			rows: []*fixtureRow{
+				{table: "users", name: "alice", deps: []string{"orgs.acme"}},
+				{table: "orders", name: "first", deps: []string{"users.alice", "orgs.acme"}},
+				{table: "orgs", name: "acme"},
+			},
+			want: []string{"orgs.acme", "users.alice", "orders.first"},
+		},
+		{
+			name: "independent rows are sorted by key",
+			rows: []*fixtureRow{
+				{table: "users", name: "bob"},
+				{table: "orgs", name: "acme"},
+				{table: "users", name: "alice"},
+			},
+			want: []string{"orgs.acme", "users.alice", "users.bob"},
+		},
+		{
+			name: "cycle",
+			rows: []*fixtureRow{
+				{table: "a", name: "x", deps: []string{"b.y"}},
+				{table: "b", name: "y", deps: []string{"a.x"}},
+			},
+			wantErr: "fixture reference cycle a.x -> b.y -> a.x",
+		},
+		{
+			name:    "unknown reference",
+			rows:    []*fixtureRow{{table: "users", name: "alice", deps: []string{"orgs.missing"}}},
+			wantErr: "fixture users.alice references unknown fixture orgs.missing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sorted, err := sortFixtures(tt.rows)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			keys := make([]string, len(sorted))
+			for i, row := range sorted {
+				keys[i] = row.key()
+			}
+			assert.Equal(t, tt.want, keys)
+		})
+	}
+}
+
+func TestSplitFixtureRef(t *testing.T) {
+	tests := []struct {
+		ref, target, column string
+	}{
+		{"orgs.acme", "orgs.acme", "id"},
+		{" orgs.acme.code ", "orgs.acme", "code"},
+	}
+
+	for _, tt := range tests {
+		target, column := splitFixtureRef(tt.ref)
+		assert.Equal(t, tt.target, target)
+		assert.Equal(t, tt.column, column)
+	}
+}
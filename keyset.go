@@ -0,0 +1,248 @@
+package utilities
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// ErrInvalidCursor is returned when a cursor is malformed, was signed with another secret or does not match the order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+type KeysetColumn struct {
+	Column string
+	Desc   bool
+}
+
+/*
+KeysetQuery describe one page of a keyset pagination.
+Columns must end with a unique column (usually the primary key) as tie-breaker so the order is total.
+Secret signs the cursors and is required, anyone could forge a cursor signed with an empty key.
+
+	//at startup
+	cursorSecret := []byte(EnvString("CURSOR_SECRET"))
+	if len(cursorSecret) == 0 {
+		log.Fatal("CURSOR_SECRET is not set")
+	}
+
+	q := KeysetQuery{
+		Columns: []KeysetColumn{{Column: "created_at", Desc: true}, {Column: "id", Desc: true}},
+		Cursor:  c.Query("cursor"),
+		Limit:   50,
+		Secret:  cursorSecret,
+	}
+*/
+type KeysetQuery struct {
+	Columns []KeysetColumn
+	Cursor  string
+	Limit   int
+	Secret  []byte
+}
+
+type KeysetResult[T any] struct {
+	Items      []T    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+}
+
+type keysetCursor struct {
+	//order signature, a cursor can only be used with the order it was created for
+	Order  string `json:"o"`
+	Values []any  `json:"v"`
+	//set when the cursor points backwards
+	Prev bool `json:"p,omitempty"`
+}
+
+func (q KeysetQuery) orderSignature() string {
+	parts := make([]string, len(q.Columns))
+	for i, c := range q.Columns {
+		parts[i] = c.Column
+		if c.Desc {
+			parts[i] = "-" + c.Column
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func (q KeysetQuery) encodeCursor(values []any, prev bool) (string, error) {
+	payload, err := json.Marshal(keysetCursor{Order: q.orderSignature(), Values: values, Prev: prev})
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, q.Secret)
+	mac.Write(payload)
+
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (q KeysetQuery) decodeCursor() (*keysetCursor, error) {
+	enc := base64.RawURLEncoding
+	payloadPart, sigPart, ok := strings.Cut(q.Cursor, ".")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	sig, err := enc.DecodeString(sigPart)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	mac := hmac.New(sha256.New, q.Secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrInvalidCursor
+	}
+
+	//keep numbers as json.Number so large ids do not lose precision
+	var cur keysetCursor
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&cur); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cur.Order != q.orderSignature() || len(cur.Values) != len(q.Columns) {
+		return nil, ErrInvalidCursor
+	}
+	return &cur, nil
+}
+
+// keysetCondition build (a > ?) OR (a = ? AND b > ?) ... so mixed directions work on every database
+func keysetCondition(cols []KeysetColumn, values []any, backward bool) clause.Expression {
+	var ors []clause.Expression
+	for i, c := range cols {
+		var ands []clause.Expression
+		for j := 0; j < i; j++ {
+			ands = append(ands, clause.Eq{Column: clause.Column{Name: cols[j].Column}, Value: values[j]})
+		}
+
+		col := clause.Column{Name: c.Column}
+		if c.Desc != backward {
+			ands = append(ands, clause.Lt{Column: col, Value: values[i]})
+		} else {
+			ands = append(ands, clause.Gt{Column: col, Value: values[i]})
+		}
+		ors = append(ors, clause.And(ands...))
+	}
+	return clause.Or(ors...)
+}
+
+/*
+FindKeyset return one page of T after (or before) the cursor of q.
+NextCursor is empty on the last page and PrevCursor is empty on the first page.
+*/
+func FindKeyset[T any](db *gorm.DB, q KeysetQuery) (KeysetResult[T], error) {
+	result := KeysetResult[T]{Items: []T{}}
+	if len(q.Columns) == 0 {
+		return result, fmt.Errorf("keyset columns are required")
+	}
+	if len(q.Secret) == 0 {
+		return result, fmt.Errorf("keyset cursor secret is required")
+	}
+	for _, c := range q.Columns {
+		for _, part := range strings.Split(c.Column, ".") {
+			if !validIdentifier(part) {
+				return result, fmt.Errorf("invalid keyset column %q", c.Column)
+			}
+		}
+	}
+	_, q.Limit = normalizePaging(1, q.Limit)
+
+	var cur *keysetCursor
+	if q.Cursor != "" {
+		var err error
+		if cur, err = q.decodeCursor(); err != nil {
+			return result, err
+		}
+	}
+	backward := cur != nil && cur.Prev
+
+	orders := make([]clause.OrderByColumn, len(q.Columns))
+	for i, c := range q.Columns {
+		orders[i] = clause.OrderByColumn{Column: clause.Column{Name: c.Column}, Desc: c.Desc != backward}
+	}
+
+	tx := db.Model(new(T)).Clauses(clause.OrderBy{Columns: orders}).Limit(q.Limit + 1)
+	if cur != nil {
+		tx = tx.Clauses(clause.Where{Exprs: []clause.Expression{keysetCondition(q.Columns, cur.Values, backward)}})
+	}
+
+	if err := tx.Find(&result.Items).Error; err != nil {
+		return result, fmt.Errorf("failed to find: %w", err)
+	}
+
+	more := len(result.Items) > q.Limit
+	if more {
+		result.Items = result.Items[:q.Limit]
+	}
+	if backward {
+		for i, j := 0, len(result.Items)-1; i < j; i, j = i+1, j-1 {
+			result.Items[i], result.Items[j] = result.Items[j], result.Items[i]
+		}
+	}
+	if len(result.Items) == 0 {
+		return result, nil
+	}
+
+	hasNext := (!backward && more) || (backward && cur != nil)
+	hasPrev := (backward && more) || (!backward && cur != nil)
+
+	sch, err := schema.Parse(new(T), listSchemaCache, db.NamingStrategy)
+	if err != nil {
+		return result, err
+	}
+
+	if hasNext {
+		values, err := keysetValues(db, sch, q.Columns, &result.Items[len(result.Items)-1])
+		if err != nil {
+			return result, err
+		}
+		if result.NextCursor, err = q.encodeCursor(values, false); err != nil {
+			return result, err
+		}
+	}
+	if hasPrev {
+		values, err := keysetValues(db, sch, q.Columns, &result.Items[0])
+		if err != nil {
+			return result, err
+		}
+		if result.PrevCursor, err = q.encodeCursor(values, true); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+func keysetValues(db *gorm.DB, sch *schema.Schema, cols []KeysetColumn, item any) ([]any, error) {
+	rv := reflect.ValueOf(item).Elem()
+	values := make([]any, len(cols))
+	for i, c := range cols {
+		name := c.Column
+		if idx := strings.LastIndex(name, "."); idx >= 0 {
+			name = name[idx+1:]
+		}
+
+		f := sch.LookUpField(name)
+		if f == nil {
+			return nil, fmt.Errorf("keyset column %s is not a field of %s", c.Column, sch.Name)
+		}
+		values[i], _ = f.ValueOf(db.Statement.Context, rv)
+	}
+	return values, nil
+}
@@ -0,0 +1,91 @@
+package utilities
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeysetCursorRoundTrip(t *testing.T) {
+	q := KeysetQuery{
+		Columns: []KeysetColumn{{Column: "created_at", Desc: true}, {Column: "id", Desc: true}},
+		Secret:  []byte("secret"),
+	}
+
+	tests := []struct {
+		name   string
+		values []any
+		prev   bool
+	}{
+		{"next", []any{"2024-01-02T03:04:05Z", 42}, false},
+		{"prev", []any{"2024-01-02T03:04:05Z", 42}, true},
+		{"large id keeps precision", []any{"2024-01-02T03:04:05Z", uint64(9007199254740993)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cursor, err := q.encodeCursor(tt.values, tt.prev)
+			require.NoError(t, err)
+
+			q := q
+			q.Cursor = cursor
+			cur, err := q.decodeCursor()
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.prev, cur.Prev)
+			require.Len(t, cur.Values, len(tt.values))
+			assert.Equal(t, tt.values[0], cur.Values[0])
+			assert.Equal(t, json.Number(jsonString(t, tt.values[1])), cur.Values[1])
+		})
+	}
+}
+
+func TestKeysetCursorRejected(t *testing.T) {
+	q := KeysetQuery{Columns: []KeysetColumn{{Column: "id"}}, Secret: []byte("secret")}
+	valid, err := q.encodeCursor([]any{1}, false)
+	require.NoError(t, err)
+
+	otherSecret := KeysetQuery{Columns: q.Columns, Secret: []byte("other")}
+	signedElsewhere, err := otherSecret.encodeCursor([]any{1}, false)
+	require.NoError(t, err)
+
+	otherOrder := KeysetQuery{Columns: []KeysetColumn{{Column: "id", Desc: true}}, Secret: q.Secret}
+	wrongOrder, err := otherOrder.encodeCursor([]any{1}, false)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"no signature", "abc"},
+		{"bad base64", "!!!.!!!"},
+		{"tampered payload", "x" + valid},
+		{"other secret", signedElsewhere},
+		{"other order", wrongOrder},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := q
+			q.Cursor = tt.cursor
+			_, err := q.decodeCursor()
+			assert.ErrorIs(t, err, ErrInvalidCursor)
+		})
+	}
+}
+
+func jsonString(t *testing.T, v any) string {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestFindKeysetRequiresSecret(t *testing.T) {
+	db := dryRunDB(t, Postgresql)
+	q := KeysetQuery{Columns: []KeysetColumn{{Column: "id"}}, Limit: 10}
+
+	_, err := FindKeyset[versionedOrder](db, q)
+	assert.EqualError(t, err, "keyset cursor secret is required")
+}
@@ -0,0 +1,293 @@
+package utilities
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+const (
+	FilterEq   = "eq"
+	FilterIn   = "in"
+	FilterLike = "like"
+	FilterGte  = "gte"
+	FilterLte  = "lte"
+)
+
+// ErrInvalidListQuery is returned for malformed list parameters and fields which are not whitelisted,
+// it should be answered with 400
+var ErrInvalidListQuery = errors.New("invalid list query")
+
+var filterParamPattern = regexp.MustCompile(`^filter\[(\w+)\](?:\[(\w+)\])?$`)
+
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+type ListFilter struct {
+	Field  string
+	Op     string
+	Values []string
+}
+
+type ListQuery struct {
+	Sort    []SortField
+	Filters []ListFilter
+	Page    int
+	Limit   int
+}
+
+type ListMeta struct {
+	Page    int   `json:"page"`
+	Limit   int   `json:"limit"`
+	Total   int64 `json:"total"`
+	Pages   int   `json:"pages"`
+	HasNext bool  `json:"has_next"`
+}
+
+type ListResult[T any] struct {
+	Items []T      `json:"items"`
+	Meta  ListMeta `json:"meta"`
+}
+
+/*
+ParseListQuery read sort, filter and paging parameters from the request query. example :
+
+	?sort=-created_at,name&filter[status]=active&filter[age][gte]=18&filter[type][in]=a,b&page=2&limit=50
+
+a "-" prefix sorts descending, filters without operator use eq, the in operator takes a comma separated list
+*/
+func ParseListQuery(c *gin.Context) (ListQuery, error) {
+	q := ListQuery{Page: 1, Limit: DefaultListLimit}
+	params := c.Request.URL.Query()
+
+	if v := params.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page <= 0 {
+			return q, fmt.Errorf("%w: page must be a positive number", ErrInvalidListQuery)
+		}
+		q.Page = page
+	}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return q, fmt.Errorf("%w: limit must be a positive number", ErrInvalidListQuery)
+		}
+		q.Limit = min(limit, MaxListLimit)
+	}
+
+	for _, v := range strings.Split(params.Get("sort"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		desc := strings.HasPrefix(v, "-")
+		q.Sort = append(q.Sort, SortField{Field: strings.TrimPrefix(v, "-"), Desc: desc})
+	}
+
+	for key, values := range params {
+		m := filterParamPattern.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+
+		op := m[2]
+		if op == "" {
+			op = FilterEq
+		}
+
+		f := ListFilter{Field: m[1], Op: op}
+		for _, v := range values {
+			if op == FilterIn {
+				f.Values = append(f.Values, strings.Split(v, ",")...)
+			} else {
+				f.Values = append(f.Values, v)
+			}
+		}
+		q.Filters = append(q.Filters, f)
+	}
+
+	return q, nil
+}
+
+type listField struct {
+	column     string
+	sortable   bool
+	filterable bool
+}
+
+var listSchemaCache = &sync.Map{}
+
+/*
+listFields read the whitelist of a model from the list tag, fields are addressed by their json name. example :
+
+	type User struct {
+		ID        int       `json:"id" list:"sort"`
+		Status    string    `json:"status" list:"sort,filter"`
+		CreatedAt time.Time `json:"created_at" list:"sort,filter"`
+	}
+*/
+func listFields(db *gorm.DB, model any) (map[string]listField, error) {
+	sch, err := schema.Parse(model, listSchemaCache, db.NamingStrategy)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]listField{}
+	for _, f := range sch.Fields {
+		tag := f.Tag.Get("list")
+		if tag == "" || f.DBName == "" {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			name = f.DBName
+		}
+
+		lf := listField{column: f.DBName}
+		for _, opt := range strings.Split(tag, ",") {
+			switch strings.TrimSpace(opt) {
+			case "sort":
+				lf.sortable = true
+			case "filter":
+				lf.filterable = true
+			}
+		}
+		fields[name] = lf
+	}
+	return fields, nil
+}
+
+// ListScope validate q against the whitelist of model and return the filter and sort scopes
+func ListScope(db *gorm.DB, model any, q ListQuery) (filter func(*gorm.DB) *gorm.DB, sort func(*gorm.DB) *gorm.DB, err error) {
+	fields, err := listFields(db, model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var conds []clause.Expression
+	for _, f := range q.Filters {
+		lf, ok := fields[f.Field]
+		if !ok || !lf.filterable {
+			return nil, nil, fmt.Errorf("%w: filter on %s is not allowed", ErrInvalidListQuery, f.Field)
+		}
+		if len(f.Values) == 0 {
+			continue
+		}
+
+		col := clause.Column{Name: lf.column}
+		switch f.Op {
+		case FilterEq:
+			conds = append(conds, clause.Eq{Column: col, Value: f.Values[0]})
+		case FilterIn:
+			values := make([]any, len(f.Values))
+			for i, v := range f.Values {
+				values[i] = v
+			}
+			conds = append(conds, clause.IN{Column: col, Values: values})
+		case FilterLike:
+			conds = append(conds, clause.Like{Column: col, Value: "%" + escapeLike(f.Values[0]) + "%"})
+		case FilterGte:
+			conds = append(conds, clause.Gte{Column: col, Value: f.Values[0]})
+		case FilterLte:
+			conds = append(conds, clause.Lte{Column: col, Value: f.Values[0]})
+		default:
+			return nil, nil, fmt.Errorf("%w: unknown filter operator %s", ErrInvalidListQuery, f.Op)
+		}
+	}
+
+	var orders []clause.OrderByColumn
+	for _, s := range q.Sort {
+		lf, ok := fields[s.Field]
+		if !ok || !lf.sortable {
+			return nil, nil, fmt.Errorf("%w: sort on %s is not allowed", ErrInvalidListQuery, s.Field)
+		}
+		orders = append(orders, clause.OrderByColumn{Column: clause.Column{Name: lf.column}, Desc: s.Desc})
+	}
+
+	filter = func(db *gorm.DB) *gorm.DB {
+		if len(conds) == 0 {
+			return db
+		}
+		return db.Clauses(clause.Where{Exprs: conds})
+	}
+	sort = func(db *gorm.DB) *gorm.DB {
+		if len(orders) == 0 {
+			return db
+		}
+		return db.Clauses(clause.OrderBy{Columns: orders})
+	}
+	return filter, sort, nil
+}
+
+func escapeLike(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(v)
+}
+
+// FindList return one page of T matching q together with the pagination meta
+func FindList[T any](db *gorm.DB, q ListQuery) (ListResult[T], error) {
+	result := ListResult[T]{Items: []T{}}
+
+	model := new(T)
+	if reflect.TypeOf(model).Elem().Kind() != reflect.Struct {
+		return result, fmt.Errorf("list model must be a struct")
+	}
+
+	filter, sort, err := ListScope(db, model, q)
+	if err != nil {
+		return result, err
+	}
+
+	page, limit := normalizePaging(q.Page, q.Limit)
+	base := db.Model(model).Scopes(filter).Session(&gorm.Session{})
+
+	var total int64
+	if err := base.Count(&total).Error; err != nil {
+		return result, fmt.Errorf("failed to count: %w", err)
+	}
+
+	if err := base.Scopes(sort, Paging(page, limit)).Find(&result.Items).Error; err != nil {
+		return result, fmt.Errorf("failed to find: %w", err)
+	}
+
+	pages := int(math.Ceil(float64(total) / float64(limit)))
+	result.Meta = ListMeta{
+		Page:    page,
+		Limit:   limit,
+		Total:   total,
+		Pages:   pages,
+		HasNext: page < pages,
+	}
+	return result, nil
+}
+
+func normalizePaging(page, limit int) (int, int) {
+	if page <= 0 {
+		page = 1
+	}
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	return page, limit
+}
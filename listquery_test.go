@@ -0,0 +1,41 @@
+package utilities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaging(t *testing.T) {
+	db := dryRunDB(t, Postgresql)
+
+	tests := []struct {
+		page, limit int
+		want        []any
+	}{
+		{1, 500, []any{500}},
+		{3, 20, []any{20, 40}},
+	}
+
+	for _, tt := range tests {
+		stmt := db.Table("orders").Scopes(Paging(tt.page, tt.limit)).Find(&[]map[string]any{}).Statement
+		assert.Equal(t, tt.want, stmt.Vars)
+	}
+}
+
+func TestNormalizePaging(t *testing.T) {
+	tests := []struct {
+		page, limit         int
+		wantPage, wantLimit int
+	}{
+		{0, 0, 1, DefaultListLimit},
+		{-2, 50, 1, 50},
+		{4, 500, 4, MaxListLimit},
+	}
+
+	for _, tt := range tests {
+		page, limit := normalizePaging(tt.page, tt.limit)
+		assert.Equal(t, tt.wantPage, page)
+		assert.Equal(t, tt.wantLimit, limit)
+	}
+}
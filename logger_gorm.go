@@ -0,0 +1,140 @@
+package utilities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/utils"
+)
+
+type ZapGormLoggerConfig struct {
+	//default logger.Warn
+	LogLevel logger.LogLevel
+	//queries slower than this are logged as warning, 0 disables. default 200ms
+	SlowThreshold             time.Duration
+	IgnoreRecordNotFoundError bool
+	//replace every query parameter with [REDACTED]
+	RedactParams bool
+	//custom parameter filter, runs after RedactParams
+	ParamsFilter func(ctx context.Context, sql string, params ...any) (string, []any)
+	//log field name to context key, the value found in the context is added to every entry.
+	//default {"tenant": "dbname"}
+	ContextKeys map[string]any
+}
+
+/*
+NewZapGormLogger return a GORM logger writing structured entries to l. example :
+
+	log, _ := NewLogger("logs/app-", false)
+	dbm := NewDBManager(cfg, WithGormLogger(NewZapGormLogger(log, ZapGormLoggerConfig{
+		SlowThreshold: 500 * time.Millisecond,
+		RedactParams:  true,
+		ContextKeys:   map[string]any{"tenant": "dbname", "request_id": "request_id"},
+	})))
+*/
+func NewZapGormLogger(l *zap.Logger, cfg ZapGormLoggerConfig) logger.Interface {
+	if cfg.LogLevel == 0 {
+		cfg.LogLevel = logger.Warn
+	}
+	if cfg.SlowThreshold == 0 {
+		cfg.SlowThreshold = 200 * time.Millisecond
+	}
+	if cfg.ContextKeys == nil {
+		cfg.ContextKeys = map[string]any{"tenant": "dbname"}
+	}
+
+	return &zapGormLogger{log: l, cfg: cfg}
+}
+
+type zapGormLogger struct {
+	log *zap.Logger
+	cfg ZapGormLoggerConfig
+}
+
+func (z *zapGormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	clone := *z
+	clone.cfg.LogLevel = level
+	return &clone
+}
+
+func (z *zapGormLogger) contextFields(ctx context.Context) []zap.Field {
+	if ctx == nil {
+		return nil
+	}
+
+	var fields []zap.Field
+	for name, key := range z.cfg.ContextKeys {
+		if v := ctx.Value(key); v != nil {
+			fields = append(fields, zap.Any(name, v))
+		}
+	}
+	return fields
+}
+
+func (z *zapGormLogger) Info(ctx context.Context, msg string, data ...any) {
+	if z.cfg.LogLevel >= logger.Info {
+		z.log.Info(fmt.Sprintf(msg, data...), z.contextFields(ctx)...)
+	}
+}
+
+func (z *zapGormLogger) Warn(ctx context.Context, msg string, data ...any) {
+	if z.cfg.LogLevel >= logger.Warn {
+		z.log.Warn(fmt.Sprintf(msg, data...), z.contextFields(ctx)...)
+	}
+}
+
+func (z *zapGormLogger) Error(ctx context.Context, msg string, data ...any) {
+	if z.cfg.LogLevel >= logger.Error {
+		z.log.Error(fmt.Sprintf(msg, data...), z.contextFields(ctx)...)
+	}
+}
+
+func (z *zapGormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if z.cfg.LogLevel <= logger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	fields := func() []zap.Field {
+		sql, rows := fc()
+		fields := append(z.contextFields(ctx),
+			zap.String("sql", sql),
+			zap.Duration("elapsed", elapsed),
+			zap.String("caller", utils.FileWithLineNum()),
+		)
+		if rows >= 0 {
+			fields = append(fields, zap.Int64("rows", rows))
+		}
+		return fields
+	}
+
+	switch {
+	case err != nil && z.cfg.LogLevel >= logger.Error && (!errors.Is(err, gorm.ErrRecordNotFound) || !z.cfg.IgnoreRecordNotFoundError):
+		z.log.Error("sql error", append(fields(), zap.Error(err))...)
+	case z.cfg.SlowThreshold > 0 && elapsed > z.cfg.SlowThreshold && z.cfg.LogLevel >= logger.Warn:
+		z.log.Warn("slow sql", append(fields(), zap.Duration("threshold", z.cfg.SlowThreshold))...)
+	case z.cfg.LogLevel >= logger.Info:
+		z.log.Info("sql", fields()...)
+	}
+}
+
+// ParamsFilter is called by GORM before the parameters are interpolated into the logged sql
+func (z *zapGormLogger) ParamsFilter(ctx context.Context, sql string, params ...any) (string, []any) {
+	if z.cfg.RedactParams {
+		redacted := make([]any, len(params))
+		for i := range params {
+			redacted[i] = "[REDACTED]"
+		}
+		params = redacted
+	}
+
+	if z.cfg.ParamsFilter != nil {
+		return z.cfg.ParamsFilter(ctx, sql, params...)
+	}
+	return sql, params
+}
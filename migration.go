@@ -0,0 +1,374 @@
+package utilities
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+)
+
+type MockMigrator struct {
+	mock.Mock
+}
+
+func (m *MockMigrator) Up(ctx context.Context) MigrationReport {
+	args := m.Called(ctx)
+	return args.Get(0).(MigrationReport)
+}
+
+func (m *MockMigrator) Down(ctx context.Context, steps int) MigrationReport {
+	args := m.Called(ctx, steps)
+	return args.Get(0).(MigrationReport)
+}
+
+func (m *MockMigrator) UpTenants(ctx context.Context, tenants []string) []MigrationReport {
+	args := m.Called(ctx, tenants)
+	return args.Get(0).([]MigrationReport)
+}
+
+func (m *MockMigrator) UpAll(ctx context.Context, lister TenantLister) ([]MigrationReport, error) {
+	args := m.Called(ctx, lister)
+	return args.Get(0).([]MigrationReport), args.Error(1)
+}
+
+// Migration is one schema version, either SQL or Go funcs are used, Go funcs take precedence
+type Migration struct {
+	Version int64
+	Name    string
+	UpSQL   string
+	DownSQL string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+type MigratorOptions struct {
+	//report pending migrations without applying them
+	DryRun bool
+	//number of tenants migrated at the same time by UpTenants and UpAll. default 4
+	Parallelism int
+	//database user of a tenant for UpTenants and UpAll, needed when the manager has no TenantResolver
+	//and the users differ per tenant. default the "dbuser" of the context
+	DBUser func(tenant string) string
+}
+
+type MigrationReport struct {
+	Tenant   string
+	DryRun   bool
+	Applied  []int64
+	Pending  []int64
+	Duration time.Duration
+	Err      error
+}
+
+// SchemaMigration is a row of the schema_migrations table of every tenant
+type SchemaMigration struct {
+	Version   int64  `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:255"`
+	AppliedAt time.Time
+}
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+/*
+LoadMigrations read the migrations in dir of fsys, files are named [version]_[name].up.sql and [version]_[name].down.sql.
+A file may hold several statements, mysql requires multiStatements=true in the connection parameters for that.
+
+	//go:embed migrations/*.sql
+	var migrationFS embed.FS
+
+	migrations, err := LoadMigrations(migrationFS, "migrations")
+*/
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration dir: %w", err)
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		m := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || m == nil {
+			continue
+		}
+
+		version, _ := strconv.ParseInt(m[1], 10, 64)
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration version %d is used by %s and %s", version, mig.Name, m[2])
+		}
+
+		if m[3] == "up" {
+			mig.UpSQL = string(content)
+		} else {
+			mig.DownSQL = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+type Migrator interface {
+	// Up apply the pending migrations to the tenant database of ctx, on postgres under an advisory lock
+	// so instances migrating the same tenant at the same time wait for each other
+	Up(ctx context.Context) MigrationReport
+	// Down revert the last steps applied migrations of the tenant database of ctx
+	Down(ctx context.Context, steps int) MigrationReport
+	// UpTenants apply the pending migrations to every tenant with bounded parallelism. Without a TenantResolver
+	// the manager also needs the database user, from MigratorOptions.DBUser or the "dbuser" of ctx
+	UpTenants(ctx context.Context, tenants []string) []MigrationReport
+	// UpAll apply the pending migrations to every tenant of lister, usually the TenantResolver of the manager
+	UpAll(ctx context.Context, lister TenantLister) ([]MigrationReport, error)
+}
+
+func NewMigrator(dbm DBManager, migrations []Migration, opts MigratorOptions) Migrator {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = 4
+	}
+
+	return &migrator{dbm: dbm, migrations: sorted, opts: opts}
+}
+
+type migrator struct {
+	dbm        DBManager
+	migrations []Migration
+	opts       MigratorOptions
+}
+
+func (m *migrator) Up(ctx context.Context) (report MigrationReport) {
+	start := time.Now()
+	report = MigrationReport{Tenant: contextString(ctx, "dbname"), DryRun: m.opts.DryRun}
+	defer func() { report.Duration = time.Since(start) }()
+
+	ctx = migrationContext(ctx)
+	db, err := m.prepare(ctx)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+
+	report.Err = m.exclusive(ctx, db, func() error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+
+			if m.opts.DryRun {
+				report.Pending = append(report.Pending, mig.Version)
+				continue
+			}
+
+			err := m.run(db, func(tx *gorm.DB) error {
+				if mig.Up != nil {
+					return mig.Up(tx)
+				}
+				return tx.Exec(mig.UpSQL).Error
+			}, func(tx *gorm.DB) error {
+				return tx.Create(&SchemaMigration{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			report.Applied = append(report.Applied, mig.Version)
+		}
+		return nil
+	})
+	return report
+}
+
+func (m *migrator) Down(ctx context.Context, steps int) (report MigrationReport) {
+	start := time.Now()
+	report = MigrationReport{Tenant: contextString(ctx, "dbname"), DryRun: m.opts.DryRun}
+	defer func() { report.Duration = time.Since(start) }()
+
+	ctx = migrationContext(ctx)
+	db, err := m.prepare(ctx)
+	if err != nil {
+		report.Err = err
+		return report
+	}
+
+	report.Err = m.exclusive(ctx, db, func() error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			steps--
+
+			if m.opts.DryRun {
+				report.Pending = append(report.Pending, mig.Version)
+				continue
+			}
+
+			if mig.Down == nil && mig.DownSQL == "" {
+				return fmt.Errorf("migration %d_%s has no down migration", mig.Version, mig.Name)
+			}
+
+			err := m.run(db, func(tx *gorm.DB) error {
+				if mig.Down != nil {
+					return mig.Down(tx)
+				}
+				return tx.Exec(mig.DownSQL).Error
+			}, func(tx *gorm.DB) error {
+				return tx.Delete(&SchemaMigration{}, mig.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			report.Applied = append(report.Applied, mig.Version)
+		}
+		return nil
+	})
+	return report
+}
+
+func (m *migrator) UpTenants(ctx context.Context, tenants []string) []MigrationReport {
+	reports := make([]MigrationReport, len(tenants))
+	sem := make(chan struct{}, m.opts.Parallelism)
+
+	var wg sync.WaitGroup
+	for i, tenant := range tenants {
+		wg.Add(1)
+		go func(i int, tenant string) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				reports[i] = MigrationReport{Tenant: tenant, DryRun: m.opts.DryRun, Err: ctx.Err()}
+				return
+			}
+
+			dbUser := ""
+			if m.opts.DBUser != nil {
+				dbUser = m.opts.DBUser(tenant)
+			}
+			reports[i] = m.Up(TenantContext(ctx, tenant, dbUser))
+		}(i, tenant)
+	}
+	wg.Wait()
+
+	return reports
+}
+
+func (m *migrator) UpAll(ctx context.Context, lister TenantLister) ([]MigrationReport, error) {
+	tenants, err := lister.Tenants(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants: %w", err)
+	}
+	return m.UpTenants(ctx, tenants), nil
+}
+
+// migrationContext read and write on the primary, a lagging replica would show applied migrations as pending,
+// and lift the default query timeout which would stop long DDL
+func migrationContext(ctx context.Context) context.Context {
+	return WithQueryTimeout(ForcePrimary(ctx), 0)
+}
+
+// exclusive run fn holding a postgres advisory lock on the tenant so instances started together
+// do not apply the same migrations. Dry runs and mysql are not locked
+func (m *migrator) exclusive(ctx context.Context, db *gorm.DB, fn func() error) error {
+	if m.opts.DryRun || db.Dialector.Name() != Postgresql {
+		return fn()
+	}
+
+	key := "utilities:migrate:" + db.Migrator().CurrentDatabase()
+	if schema := TenantSchema(db); schema != "" {
+		key += "." + schema
+	}
+	return WithAdvisoryLock(ctx, db, key, func(context.Context) error {
+		return fn()
+	})
+}
+
+// prepare return the tenant db and make sure the tenant schema and schema_migrations table exist,
+// nothing is created in dry run
+func (m *migrator) prepare(ctx context.Context) (*gorm.DB, error) {
+	db, err := m.dbm.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.opts.DryRun {
+		return db, nil
+	}
+
+	if schema := TenantSchema(db); schema != "" {
+		if err := db.Exec(fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS "%s"`, schema)).Error; err != nil {
+			return nil, fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	return db, nil
+}
+
+func (m *migrator) applied(db *gorm.DB) (map[int64]struct{}, error) {
+	if m.opts.DryRun && !db.Migrator().HasTable(&SchemaMigration{}) {
+		return map[int64]struct{}{}, nil
+	}
+
+	var versions []int64
+	if err := db.Model(&SchemaMigration{}).Pluck("version", &versions).Error; err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+
+	applied := make(map[int64]struct{}, len(versions))
+	for _, v := range versions {
+		applied[v] = struct{}{}
+	}
+	return applied, nil
+}
+
+// run execute the migration and its bookkeeping in one transaction,
+// scoped to the tenant schema in schema per tenant mode so raw sql hits the right tables
+func (m *migrator) run(db *gorm.DB, migrate, record func(tx *gorm.DB) error) error {
+	fn := func(tx *gorm.DB) error {
+		if err := migrate(tx); err != nil {
+			return err
+		}
+		return record(tx)
+	}
+
+	if TenantSchema(db) != "" {
+		return WithTenantSearchPath(db, fn)
+	}
+	return db.Transaction(fn)
+}
@@ -0,0 +1,18 @@
+package utilities
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationContext(t *testing.T) {
+	ctx := migrationContext(context.Background())
+
+	assert.True(t, isForcePrimary(ctx), "migrations must not read from a replica")
+	timeout, ok := ctx.Value(queryTimeoutKey{}).(time.Duration)
+	assert.True(t, ok)
+	assert.Zero(t, timeout, "the default query timeout must not stop long DDL")
+}
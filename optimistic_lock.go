@@ -0,0 +1,177 @@
+package utilities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// ErrStaleRecord is returned when the record was changed (or deleted) since it was read
+var ErrStaleRecord = errors.New("stale record")
+
+const versionColumn = "version"
+
+/*
+SaveVersioned update every column of record when its version column still holds the version it was read with,
+the version is incremented on the record. ErrStaleRecord means another writer got there first.
+
+	type Order struct {
+		ID      uint
+		Status  string
+		Version int64
+	}
+
+	order.Status = "paid"
+	err := SaveVersioned(db, &order)
+*/
+func SaveVersioned(db *gorm.DB, record any) error {
+	return updateVersioned(db, record, nil)
+}
+
+// UpdateVersioned update the given columns of record with the same version check as SaveVersioned.
+// On error the record is left as it was before the call, GORM copies the values into it while updating
+func UpdateVersioned(db *gorm.DB, record any, values map[string]any) error {
+	if values == nil {
+		values = map[string]any{}
+	}
+	return updateVersioned(db, record, values)
+}
+
+func updateVersioned(db *gorm.DB, record any, values map[string]any) error {
+	rv := reflect.ValueOf(record)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("versioned record must be a pointer to a struct")
+	}
+	rv = rv.Elem()
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(record); err != nil {
+		return fmt.Errorf("failed to parse model: %w", err)
+	}
+	field := stmt.Schema.LookUpField(versionColumn)
+	if field == nil {
+		return fmt.Errorf("%s has no %s column", stmt.Schema.Name, versionColumn)
+	}
+
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	//without a primary key the version check alone would match every row at that version
+	if len(stmt.Schema.PrimaryFields) == 0 {
+		return fmt.Errorf("%s: %w", stmt.Schema.Name, gorm.ErrPrimaryKeyRequired)
+	}
+	for _, pk := range stmt.Schema.PrimaryFields {
+		if _, zero := pk.ValueOf(ctx, rv); zero {
+			return fmt.Errorf("%s.%s is empty: %w", stmt.Schema.Name, pk.Name, gorm.ErrPrimaryKeyRequired)
+		}
+	}
+
+	raw, _ := field.ValueOf(ctx, rv)
+	current, err := versionNumber(raw)
+	if err != nil {
+		return err
+	}
+
+	//GORM writes the updated columns and updated_at into record, a failed update puts the read values back
+	saved := reflect.New(rv.Type()).Elem()
+	saved.Set(rv)
+
+	tx := db.Model(record).Clauses(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: current},
+	}})
+
+	var res *gorm.DB
+	if values == nil {
+		if err := field.Set(ctx, rv, current+1); err != nil {
+			return err
+		}
+		res = tx.Select("*").Omit(autoCreateColumns(stmt.Schema)...).Updates(record)
+	} else {
+		updates := make(map[string]any, len(values)+1)
+		for k, v := range values {
+			updates[k] = v
+		}
+		updates[field.DBName] = current + 1
+		res = tx.Updates(updates)
+	}
+
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = ErrStaleRecord
+	}
+	if res.Error != nil {
+		//keep the version and values the record was read with so the caller can reload or report it
+		rv.Set(saved)
+		return res.Error
+	}
+	return field.Set(ctx, rv, current+1)
+}
+
+/*
+RetryVersioned load the record with the primary key id, pass it to fn and save it with SaveVersioned.
+The whole read-modify-write is retried up to attempts times (default 3) when the save hits ErrStaleRecord.
+The record is read from the primary since a replica may not have the last version yet.
+
+	order, err := RetryVersioned[Order](db, id, 5, func(o *Order) error {
+		o.Total += amount
+		return nil
+	})
+*/
+func RetryVersioned[T any](db *gorm.DB, id any, attempts int, fn func(record *T) error) (*T, error) {
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	db = db.WithContext(ForcePrimary(ctx))
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		record := new(T)
+		if err = db.Where(clause.Eq{Column: clause.PrimaryColumn, Value: id}).First(record).Error; err != nil {
+			return nil, err
+		}
+		if err = fn(record); err != nil {
+			return nil, err
+		}
+
+		err = SaveVersioned(db, record)
+		if err == nil {
+			return record, nil
+		}
+		if !errors.Is(err, ErrStaleRecord) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("failed after %d attempts: %w", attempts, err)
+}
+
+func versionNumber(v any) (int64, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(rv.Uint()), nil
+	}
+	return 0, fmt.Errorf("version column must be an integer, got %T", v)
+}
+
+func autoCreateColumns(sch *schema.Schema) []string {
+	var cols []string
+	for _, f := range sch.Fields {
+		if f.DBName != "" && f.AutoCreateTime > 0 {
+			cols = append(cols, f.DBName)
+		}
+	}
+	return cols
+}
@@ -0,0 +1,63 @@
+package utilities
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type versionedOrder struct {
+	ID      string `gorm:"primaryKey"`
+	Status  string
+	Total   int
+	Version int64
+}
+
+// dryRunDB return a db which builds statements without sending them, every write affects no row
+func dryRunDB(t *testing.T, dbtype string) *gorm.DB {
+	conn, err := sql.Open(Postgresql, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	cfg := gormConfig(dbtype, CreateLogger(false), false)
+	cfg.DryRun = true
+	cfg.DisableAutomaticPing = true
+	cfg.SkipDefaultTransaction = true
+	db, err := gorm.Open(gormDialector(dbtype, conn), cfg)
+	require.NoError(t, err)
+	return db
+}
+
+func TestUpdateVersionedStaleRestoresRecord(t *testing.T) {
+	db := dryRunDB(t, Postgresql)
+	order := versionedOrder{ID: "7f8c1a52-1b7e-4c55-9c1e-2b2a0b4f5d11", Status: "new", Total: 10, Version: 3}
+
+	err := UpdateVersioned(db, &order, map[string]any{"status": "paid", "total": 20})
+	assert.ErrorIs(t, err, ErrStaleRecord)
+	assert.Equal(t, versionedOrder{ID: order.ID, Status: "new", Total: 10, Version: 3}, order)
+
+	err = SaveVersioned(db, &order)
+	assert.ErrorIs(t, err, ErrStaleRecord)
+	assert.Equal(t, int64(3), order.Version)
+}
+
+func TestRetryVersionedStringID(t *testing.T) {
+	db := dryRunDB(t, Postgresql)
+	id := "1 = 1; DROP TABLE versioned_orders"
+
+	var stmt *gorm.Statement
+	require.NoError(t, db.Callback().Query().After("gorm:query").Register("test:capture", func(tx *gorm.DB) {
+		stmt = tx.Statement
+		tx.AddError(errors.New("stop"))
+	}))
+
+	_, err := RetryVersioned[versionedOrder](db, id, 1, func(*versionedOrder) error { return nil })
+	require.Error(t, err)
+	require.NotNil(t, stmt)
+	assert.Contains(t, stmt.SQL.String(), `WHERE "versioned_orders"."id" = $1`)
+	assert.Equal(t, id, stmt.Vars[0])
+}
@@ -0,0 +1,331 @@
+package utilities
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type MockOutboxRelay struct {
+	mock.Mock
+}
+
+func (m *MockOutboxRelay) Run(ctx context.Context, lister TenantLister) error {
+	args := m.Called(ctx, lister)
+	return args.Error(0)
+}
+
+func (m *MockOutboxRelay) Relay(ctx context.Context) (int, error) {
+	args := m.Called(ctx)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockOutboxRelay) Cleanup(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+const outboxTable = "outbox"
+
+// OutboxMessage is a row of the outbox table
+type OutboxMessage struct {
+	ID            uint64 `gorm:"primaryKey"`
+	Queue         string `gorm:"size:255"`
+	Payload       []byte
+	Status        string `gorm:"size:16;index:idx_outbox_poll,priority:1"`
+	Attempts      int
+	LastError     string    `gorm:"type:text"`
+	NextAttemptAt time.Time `gorm:"index:idx_outbox_poll,priority:2"`
+	CreatedAt     time.Time
+	SentAt        *time.Time
+}
+
+// AuditEnabled keep the outbox out of the audit trail
+func (OutboxMessage) AuditEnabled() bool {
+	return false
+}
+
+// MigrateOutbox create the outbox table of the tenant database of db
+func MigrateOutbox(db *gorm.DB) error {
+	return db.Table(TenantTable(db, outboxTable)).AutoMigrate(&OutboxMessage{})
+}
+
+/*
+EnqueueOutbox store a message in the outbox, pass the transaction of the change the message is about
+so both are committed or rolled back together. The relay publishes it after the commit.
+
+	err := WithTx(dbm, ctx, nil, func(tx *gorm.DB) error {
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+		return EnqueueOutbox(tx, "order.created", payload)
+	})
+*/
+func EnqueueOutbox(tx *gorm.DB, queue string, payload []byte) error {
+	msg := OutboxMessage{
+		Queue:         queue,
+		Payload:       payload,
+		Status:        OutboxPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := tx.Session(&gorm.Session{NewDB: true}).Table(TenantTable(tx, outboxTable)).Create(&msg).Error; err != nil {
+		return fmt.Errorf("failed to enqueue outbox message: %w", err)
+	}
+	return nil
+}
+
+// EnqueueOutboxJSON is EnqueueOutbox with v encoded as json
+func EnqueueOutboxJSON(tx *gorm.DB, queue string, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbox message: %w", err)
+	}
+	return EnqueueOutbox(tx, queue, payload)
+}
+
+type OutboxRelayConfig struct {
+	//time between polls when the outbox is empty, default 1s
+	PollInterval time.Duration
+	//rows locked and published per transaction, default 100
+	BatchSize int
+	//a message is marked failed after this many failed publishes, default 10
+	MaxAttempts int
+	//first retry delay, doubled on every attempt up to MaxBackoff. default 1s and 5m
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	//sent and failed rows older than this are deleted by Cleanup, default 7 days
+	Retention time.Duration
+	//time between cleanups in Run, default 1h
+	CleanupInterval time.Duration
+	//errors of the background loop are logged here, default no logging
+	Logger *zap.Logger
+	//database user of a tenant for Run, needed when the manager has no TenantResolver
+	//and the users differ per tenant. default the "dbuser" of the context
+	DBUser func(tenant string) string
+	//tenants relayed per poll by Run, taken in turn so every tenant is reached. default every tenant.
+	//Every poll uses the pool of the tenants it relays, so they are never idle evicted by DBManager,
+	//keep it at or below DBConfiguration.MaxTenantPools so a poll does not open and evict pools over and over
+	TenantsPerPoll int
+}
+
+type OutboxRelay interface {
+	// Run relay the outbox of every tenant of lister until ctx is done, the tenant of ctx only when lister is nil
+	Run(ctx context.Context, lister TenantLister) error
+	// Relay publish one batch of due messages of the tenant of ctx and return the number of messages handled
+	Relay(ctx context.Context) (int, error)
+	// Cleanup delete the sent and failed messages of the tenant of ctx older than the retention
+	Cleanup(ctx context.Context) (int64, error)
+}
+
+/*
+NewOutboxRelay publish outbox messages through mq. Delivery is at least once, a message published right before
+a crash is published again, so consumers must be idempotent. Relays on several instances share the work,
+rows are locked with FOR UPDATE SKIP LOCKED.
+
+	relay := NewOutboxRelay(dbm, mq, OutboxRelayConfig{Logger: logger})
+	go relay.Run(ctx, resolver)
+*/
+func NewOutboxRelay(dbm DBManager, mq RabbitMQ, cfg OutboxRelayConfig) OutboxRelay {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 10
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = 7 * 24 * time.Hour
+	}
+	if cfg.CleanupInterval <= 0 {
+		cfg.CleanupInterval = time.Hour
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop()
+	}
+	return &outboxRelay{dbm: dbm, mq: mq, cfg: cfg}
+}
+
+type outboxRelay struct {
+	dbm DBManager
+	mq  RabbitMQ
+	cfg OutboxRelayConfig
+	//index of the first tenant of the next poll when TenantsPerPoll is set
+	next int
+}
+
+func (r *outboxRelay) Run(ctx context.Context, lister TenantLister) error {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	lastCleanup := time.Time{}
+	//tenants still to clean up, with TenantsPerPoll a cleanup spreads over the polls of one round
+	cleanupLeft := 0
+	for {
+		tenantCtxs, total := r.tenants(ctx, lister)
+		if total > 0 && time.Since(lastCleanup) >= r.cfg.CleanupInterval {
+			lastCleanup = time.Now()
+			cleanupLeft = total
+		}
+
+		for _, tenantCtx := range tenantCtxs {
+			r.relayAll(tenantCtx)
+			if cleanupLeft > 0 {
+				cleanupLeft--
+				if _, err := r.Cleanup(tenantCtx); err != nil {
+					r.cfg.Logger.Error("outbox cleanup", zap.String("tenant", contextString(tenantCtx, "dbname")), zap.Error(err))
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// tenants return the contexts of the tenants of the next poll and the number of tenants
+func (r *outboxRelay) tenants(ctx context.Context, lister TenantLister) ([]context.Context, int) {
+	if lister == nil {
+		return []context.Context{ctx}, 1
+	}
+
+	tenants, err := lister.Tenants(ctx)
+	if err != nil {
+		r.cfg.Logger.Error("outbox list tenants", zap.Error(err))
+		return nil, 0
+	}
+
+	total := len(tenants)
+	if n := r.cfg.TenantsPerPoll; n > 0 && n < total {
+		start := r.next % total
+		r.next = start + n
+		batch := make([]string, n)
+		for i := range batch {
+			batch[i] = tenants[(start+i)%total]
+		}
+		tenants = batch
+	}
+
+	ctxs := make([]context.Context, len(tenants))
+	for i, tenant := range tenants {
+		dbUser := ""
+		if r.cfg.DBUser != nil {
+			dbUser = r.cfg.DBUser(tenant)
+		}
+		ctxs[i] = TenantContext(ctx, tenant, dbUser)
+	}
+	return ctxs, total
+}
+
+// relayAll relay batches until the due messages are drained
+func (r *outboxRelay) relayAll(ctx context.Context) {
+	for ctx.Err() == nil {
+		n, err := r.Relay(ctx)
+		if err != nil {
+			r.cfg.Logger.Error("outbox relay", zap.String("tenant", contextString(ctx, "dbname")), zap.Error(err))
+			return
+		}
+		if n < r.cfg.BatchSize {
+			return
+		}
+	}
+}
+
+func (r *outboxRelay) Relay(ctx context.Context) (int, error) {
+	db, err := r.dbm.DB(ForcePrimary(ctx))
+	if err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	err = db.Transaction(func(tx *gorm.DB) error {
+		table := TenantTable(tx, outboxTable)
+
+		var msgs []OutboxMessage
+		err := tx.Table(table).
+			Where("status = ? AND next_attempt_at <= ?", OutboxPending, time.Now()).
+			Order("id").
+			Limit(r.cfg.BatchSize).
+			Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Find(&msgs).Error
+		if err != nil {
+			return fmt.Errorf("failed to poll outbox: %w", err)
+		}
+
+		for _, msg := range msgs {
+			updates := r.publish(msg)
+			if err := tx.Table(table).Where("id = ?", msg.ID).Updates(updates).Error; err != nil {
+				return fmt.Errorf("failed to update outbox message %d: %w", msg.ID, err)
+			}
+		}
+		processed = len(msgs)
+		return nil
+	})
+	return processed, err
+}
+
+// publish send msg and return the columns recording the outcome
+func (r *outboxRelay) publish(msg OutboxMessage) map[string]any {
+	err := r.mq.Publish(msg.Queue, msg.Payload)
+	now := time.Now()
+	if err == nil {
+		return map[string]any{"status": OutboxSent, "sent_at": now, "attempts": msg.Attempts + 1, "last_error": ""}
+	}
+
+	attempts := msg.Attempts + 1
+	updates := map[string]any{"attempts": attempts, "last_error": err.Error()}
+	if attempts >= r.cfg.MaxAttempts {
+		updates["status"] = OutboxFailed
+		r.cfg.Logger.Error("outbox message failed", zap.Uint64("id", msg.ID), zap.String("queue", msg.Queue), zap.Error(err))
+	} else {
+		updates["next_attempt_at"] = now.Add(r.backoff(attempts))
+	}
+	return updates
+}
+
+func (r *outboxRelay) backoff(attempts int) time.Duration {
+	d := float64(r.cfg.BaseBackoff) * math.Pow(2, float64(attempts-1))
+	if d > float64(r.cfg.MaxBackoff) {
+		return r.cfg.MaxBackoff
+	}
+	return time.Duration(d)
+}
+
+func (r *outboxRelay) Cleanup(ctx context.Context) (int64, error) {
+	db, err := r.dbm.DB(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	before := time.Now().Add(-r.cfg.Retention)
+	res := db.Table(TenantTable(db, outboxTable)).
+		Where("status IN ? AND created_at < ?", []string{OutboxSent, OutboxFailed}, before).
+		Delete(&OutboxMessage{})
+	if res.Error != nil {
+		return 0, fmt.Errorf("failed to clean up outbox: %w", res.Error)
+	}
+	return res.RowsAffected, nil
+}
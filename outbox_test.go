@@ -0,0 +1,38 @@
+package utilities
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboxRelayTenants(t *testing.T) {
+	lister := NewStaticTenantResolver(map[string]DBConfiguration{"a": {}, "b": {}, "c": {}}).(TenantLister)
+	relay := NewOutboxRelay(nil, nil, OutboxRelayConfig{
+		TenantsPerPoll: 2,
+		DBUser:         func(tenant string) string { return "user_" + tenant },
+	}).(*outboxRelay)
+
+	poll := func() ([]string, []string) {
+		ctxs, total := relay.tenants(context.Background(), lister)
+		assert.Equal(t, 3, total)
+
+		var tenants, users []string
+		for _, ctx := range ctxs {
+			tenants = append(tenants, contextString(ctx, "dbname"))
+			users = append(users, contextString(ctx, "dbuser"))
+		}
+		return tenants, users
+	}
+
+	tenants, users := poll()
+	assert.Equal(t, []string{"a", "b"}, tenants)
+	assert.Equal(t, []string{"user_a", "user_b"}, users)
+
+	tenants, _ = poll()
+	assert.Equal(t, []string{"c", "a"}, tenants)
+
+	tenants, _ = poll()
+	assert.Equal(t, []string{"b", "c"}, tenants)
+}
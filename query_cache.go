@@ -0,0 +1,306 @@
+package utilities
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/callbacks"
+	"gorm.io/gorm/schema"
+)
+
+type MockQueryCache struct {
+	mock.Mock
+}
+
+func (m *MockQueryCache) Name() string {
+	return "utilities:query_cache"
+}
+
+func (m *MockQueryCache) Initialize(db *gorm.DB) error {
+	args := m.Called(db)
+	return args.Error(0)
+}
+
+func (m *MockQueryCache) Invalidate(ctx context.Context, table string) error {
+	args := m.Called(ctx, table)
+	return args.Error(0)
+}
+
+// Cacheable opt a model in the query cache, CacheTTL 0 uses the default TTL of the cache
+type Cacheable interface {
+	CacheTTL() time.Duration
+}
+
+type noCacheKey struct{}
+
+// NoCache bypass the query cache for queries made with ctx, the result is not stored either
+func NoCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+func isNoCache(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	v, _ := ctx.Value(noCacheKey{}).(bool)
+	return v
+}
+
+type QueryCacheConfig struct {
+	//ttl of models whose CacheTTL returns 0, default 5 minutes
+	DefaultTTL time.Duration
+	//invalidations run after the write succeeded, their errors are logged. default no logging
+	Logger *zap.Logger
+}
+
+type QueryCache interface {
+	gorm.Plugin
+	// Invalidate drop the cached queries of table for the tenant of ctx, for tables changed with raw sql
+	Invalidate(ctx context.Context, table string) error
+}
+
+/*
+NewQueryCachePlugin cache the results of queries on Cacheable models in rds, redis calls use the statement context.
+Entries are keyed by tenant, table generation and a hash of the SQL and its arguments. Creates, updates and deletes
+through GORM of Cacheable models, or without model, move the generation of their table, which orphans the old entries
+until they expire; inside WithTx this happens after the commit. Queries in a transaction, with a locking clause,
+reading other tables through joins or subqueries, or on models with encrypted columns are never cached.
+
+GORM Transaction and Begin give no commit hook, writes made there move the generation before the commit and
+a reader can cache the old rows in between. Use WithTx, or call Invalidate once such a transaction committed.
+
+	func (Province) CacheTTL() time.Duration { return time.Hour }
+
+	dbm := NewDBManager(cfg, WithGormPlugins(NewQueryCachePlugin(rds, QueryCacheConfig{})))
+	db.Find(&provinces)                        //cached
+	db.WithContext(NoCache(ctx)).Find(&provinces) //always from the database
+*/
+func NewQueryCachePlugin(rds RedisContext, cfg QueryCacheConfig) QueryCache {
+	if cfg.DefaultTTL <= 0 {
+		cfg.DefaultTTL = 5 * time.Minute
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop()
+	}
+	return &queryCache{rds: rds, cfg: cfg}
+}
+
+type queryCache struct {
+	rds   RedisContext
+	cfg   QueryCacheConfig
+	query func(*gorm.DB)
+}
+
+func (c *queryCache) Name() string {
+	return "utilities:query_cache"
+}
+
+func (c *queryCache) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	c.query = cb.Query().Get("gorm:query")
+	if c.query == nil {
+		c.query = callbacks.Query
+	}
+
+	if err := cb.Query().Replace("gorm:query", c.cachedQuery); err != nil {
+		return err
+	}
+	if err := cb.Create().After("gorm:commit_or_rollback_transaction").Register("utilities:cache_create", c.invalidate); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:commit_or_rollback_transaction").Register("utilities:cache_update", c.invalidate); err != nil {
+		return err
+	}
+	return cb.Delete().After("gorm:commit_or_rollback_transaction").Register("utilities:cache_delete", c.invalidate)
+}
+
+// ttl return the ttl of a cacheable statement, ok is false when the query must go to the database
+func (c *queryCache) ttl(db *gorm.DB) (time.Duration, bool) {
+	stmt := db.Statement
+	if db.Error != nil || db.DryRun || stmt.Schema == nil || isNoCache(stmt.Context) {
+		return 0, false
+	}
+	if _, inTx := stmt.ConnPool.(gorm.TxCommitter); inTx {
+		return 0, false
+	}
+	if _, locking := stmt.Clauses["FOR"]; locking {
+		return 0, false
+	}
+	if hasEncryptedColumn(stmt.Schema) {
+		return 0, false
+	}
+
+	//only struct destinations, gob cannot rebuild maps of interfaces
+	dest := reflect.TypeOf(stmt.Dest)
+	for dest != nil && (dest.Kind() == reflect.Ptr || dest.Kind() == reflect.Slice) {
+		dest = dest.Elem()
+	}
+	if dest == nil || dest.Kind() != reflect.Struct {
+		return 0, false
+	}
+
+	cacheable, ok := reflect.New(stmt.Schema.ModelType).Interface().(Cacheable)
+	if !ok {
+		return 0, false
+	}
+	if ttl := cacheable.CacheTTL(); ttl > 0 {
+		return ttl, true
+	}
+	return c.cfg.DefaultTTL, true
+}
+
+func (c *queryCache) cachedQuery(db *gorm.DB) {
+	ttl, ok := c.ttl(db)
+	if !ok {
+		c.query(db)
+		return
+	}
+
+	callbacks.BuildQuerySQL(db)
+	if db.Error != nil {
+		return
+	}
+
+	//entries only follow the generation of the model table
+	if readsOtherTables(db.Statement.SQL.String()) {
+		c.query(db)
+		return
+	}
+
+	key, err := c.key(db)
+	if err != nil {
+		c.query(db)
+		return
+	}
+
+	if cached, err := c.rds.GetContext(db.Statement.Context, key); err == nil {
+		if rows, err := decodeCached(db.Statement.Dest, cached); err == nil {
+			db.RowsAffected = rows
+			return
+		}
+	}
+
+	c.query(db)
+	if db.Error != nil || db.RowsAffected == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(db.Statement.Dest); err != nil {
+		return
+	}
+	c.rds.SetWithDurationContext(db.Statement.Context, key, buf.String()+"|"+strconv.FormatInt(db.RowsAffected, 10), ttl)
+}
+
+var (
+	joinPattern = regexp.MustCompile(`(?i)\bJOIN\b`)
+	fromPattern = regexp.MustCompile(`(?i)\bFROM\b`)
+)
+
+// readsOtherTables report whether sql may read more than one table, through a join or a subquery
+func readsOtherTables(sql string) bool {
+	return joinPattern.MatchString(sql) || len(fromPattern.FindAllStringIndex(sql, 2)) > 1
+}
+
+func decodeCached(dest any, cached string) (int64, error) {
+	idx := strings.LastIndex(cached, "|")
+	if idx < 0 {
+		return 0, fmt.Errorf("malformed cache entry")
+	}
+	rows, err := strconv.ParseInt(cached[idx+1:], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	//reset the destination, gob leaves fields missing from the entry untouched
+	rv := reflect.ValueOf(dest).Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	if err := gob.NewDecoder(strings.NewReader(cached[:idx])).Decode(dest); err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
+
+// key hash the normalized sql and its arguments under the current generation of the table
+func (c *queryCache) key(db *gorm.DB) (string, error) {
+	stmt := db.Statement
+	gen, err := c.generation(stmt.Context, stmt.Table)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(strings.Join(strings.Fields(stmt.SQL.String()), " ")))
+	for _, v := range stmt.Vars {
+		fmt.Fprintf(h, "|%T:%v", v, v)
+	}
+	return "qc:" + cacheTenant(stmt.Context) + ":" + stmt.Table + ":" + gen + ":" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *queryCache) generationKey(ctx context.Context, table string) string {
+	return "qc_gen:" + cacheTenant(ctx) + ":" + table
+}
+
+// generation return the current generation of table, a missing generation is "0"
+func (c *queryCache) generation(ctx context.Context, table string) (string, error) {
+	gen, err := c.rds.GetContext(ctx, c.generationKey(ctx, table))
+	if err != nil {
+		if isRedisNil(err) {
+			return "0", nil
+		}
+		return "", err
+	}
+	return gen, nil
+}
+
+func (c *queryCache) invalidate(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || db.DryRun || stmt.Table == "" {
+		return
+	}
+	//writes without model may touch a cached table, models which are not Cacheable are never cached
+	if stmt.Schema != nil {
+		if _, ok := reflect.New(stmt.Schema.ModelType).Interface().(Cacheable); !ok {
+			return
+		}
+	}
+
+	//the statement context may be a query timeout cancelled before the commit hooks run
+	ctx, table := context.WithoutCancel(stmt.Context), stmt.Table
+	AfterCommit(db, func() {
+		if err := c.Invalidate(ctx, table); err != nil {
+			c.cfg.Logger.Error("query cache invalidate", zap.String("table", table), zap.Error(err))
+		}
+	})
+}
+
+func (c *queryCache) Invalidate(ctx context.Context, table string) error {
+	//a new unique generation, the generation key outlives every entry so it is kept without expiry
+	return c.rds.SetWithDurationContext(ctx, c.generationKey(ctx, table), strconv.FormatInt(time.Now().UnixNano(), 36), 0)
+}
+
+// cacheTenant identify the tenant database and the shared table tenant of ctx
+func cacheTenant(ctx context.Context) string {
+	return contextString(ctx, "dbname") + "/" + TenantID(ctx)
+}
+
+func hasEncryptedColumn(sch *schema.Schema) bool {
+	for _, f := range sch.Fields {
+		if reflect.PointerTo(f.IndirectFieldType).Implements(encryptedColumnType) {
+			return true
+		}
+	}
+	return false
+}
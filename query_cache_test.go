@@ -0,0 +1,76 @@
+package utilities
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+type cachedProvince struct {
+	ID   uint
+	Name string
+}
+
+func (cachedProvince) CacheTTL() time.Duration { return time.Hour }
+
+type uncachedOrder struct {
+	ID     uint
+	Status string
+}
+
+func TestReadsOtherTables(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{`SELECT * FROM "provinces" WHERE "provinces"."id" = $1`, false},
+		{`SELECT "provinces"."id","Country"."id" FROM "provinces" LEFT JOIN "countries" "Country" ON ...`, true},
+		{`SELECT * FROM "provinces" WHERE country_id IN (SELECT id FROM countries)`, true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, readsOtherTables(tt.sql), tt.sql)
+	}
+}
+
+func TestQueryCacheInvalidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		model      any
+		table      string
+		invalidate bool
+	}{
+		{"cacheable model", &cachedProvince{}, "cached_provinces", true},
+		{"model without cache", &uncachedOrder{}, "uncached_orders", false},
+		{"no model", nil, "cached_provinces", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rds := &MockRedis{}
+			rds.On("SetWithDurationContext", mock.Anything, "qc_gen:/:"+tt.table, mock.Anything, time.Duration(0)).Return(nil)
+			c := NewQueryCachePlugin(rds, QueryCacheConfig{}).(*queryCache)
+
+			stmt := &gorm.Statement{Context: context.Background(), Table: tt.table}
+			if tt.model != nil {
+				sch, err := schema.Parse(tt.model, &sync.Map{}, schema.NamingStrategy{})
+				require.NoError(t, err)
+				stmt.Schema = sch
+			}
+
+			c.invalidate(&gorm.DB{Config: &gorm.Config{}, Statement: stmt})
+			if tt.invalidate {
+				rds.AssertExpectations(t)
+			} else {
+				rds.AssertNotCalled(t, "SetWithDurationContext", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
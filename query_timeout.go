@@ -0,0 +1,108 @@
+package utilities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrQueryTimeout is returned when a statement ran past its deadline, client side or server side
+var ErrQueryTimeout = errors.New("query timeout")
+
+const queryTimeoutStateKey = "utilities:query_timeout_state"
+
+type queryTimeoutKey struct{}
+
+type queryTimeoutState struct {
+	parent context.Context
+	cancel context.CancelFunc
+}
+
+/*
+WithQueryTimeout override the default query timeout for statements made with ctx, d <= 0 disables it.
+A deadline already set on ctx always wins over the default. DBConfiguration.StatementTimeout is enforced by the server
+and still stops longer statements.
+
+	db, _ := dbm.DB(WithQueryTimeout(ctx, 2*time.Minute))
+	db.Raw(reportSQL).Scan(&rows)
+*/
+func WithQueryTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, queryTimeoutKey{}, d)
+}
+
+/*
+NewQueryTimeoutPlugin give every statement without a context deadline a deadline of timeout,
+and report timeouts as ErrQueryTimeout. DBManager registers it when DBConfiguration.QueryTimeout is set.
+*/
+func NewQueryTimeoutPlugin(timeout time.Duration) gorm.Plugin {
+	return &queryTimeoutPlugin{timeout: timeout}
+}
+
+type queryTimeoutPlugin struct {
+	timeout time.Duration
+}
+
+func (p *queryTimeoutPlugin) Name() string {
+	return "utilities:query_timeout"
+}
+
+func (p *queryTimeoutPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	for _, err := range []error{
+		cb.Create().Before("*").Register("utilities:timeout_before_create", p.before),
+		cb.Create().After("*").Register("utilities:timeout_after_create", p.after),
+		cb.Query().Before("*").Register("utilities:timeout_before_query", p.before),
+		cb.Query().After("*").Register("utilities:timeout_after_query", p.after),
+		cb.Update().Before("*").Register("utilities:timeout_before_update", p.before),
+		cb.Update().After("*").Register("utilities:timeout_after_update", p.after),
+		cb.Delete().Before("*").Register("utilities:timeout_before_delete", p.before),
+		cb.Delete().After("*").Register("utilities:timeout_after_delete", p.after),
+		cb.Raw().Before("*").Register("utilities:timeout_before_raw", p.before),
+		cb.Raw().After("*").Register("utilities:timeout_after_raw", p.after),
+		//the *sql.Row or *sql.Rows of a row statement is read after the callbacks returned,
+		//so its deadline is left to expire instead of being cancelled
+		cb.Row().Before("*").Register("utilities:timeout_before_row", p.before),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *queryTimeoutPlugin) before(db *gorm.DB) {
+	ctx := db.Statement.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return
+	}
+
+	timeout := p.timeout
+	if d, ok := ctx.Value(queryTimeoutKey{}).(time.Duration); ok {
+		timeout = d
+	}
+	if timeout <= 0 {
+		return
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	db.Statement.Context = timeoutCtx
+	db.Statement.Settings.Store(queryTimeoutStateKey, queryTimeoutState{parent: ctx, cancel: cancel})
+}
+
+func (p *queryTimeoutPlugin) after(db *gorm.DB) {
+	//restore the caller context so a statement chained on the result does not inherit the expired deadline
+	if v, ok := db.Statement.Settings.LoadAndDelete(queryTimeoutStateKey); ok {
+		state := v.(queryTimeoutState)
+		state.cancel()
+		db.Statement.Context = state.parent
+	}
+	if IsQueryTimeout(db.Error) && !errors.Is(db.Error, ErrQueryTimeout) {
+		db.Error = fmt.Errorf("%w: %w", ErrQueryTimeout, db.Error)
+	}
+}
@@ -2,6 +2,7 @@ package utilities
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
@@ -72,7 +73,58 @@ func (m *MockRedis) PrintKeys() {
 	m.Called()
 }
 
+func (m *MockRedis) PingContext(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func (m *MockRedis) GetContext(ctx context.Context, name string) (string, error) {
+	args := m.Called(ctx, name)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockRedis) SetContext(ctx context.Context, name string, value string) error {
+	args := m.Called(ctx, name, value)
+	return args.Error(0)
+}
+
+func (m *MockRedis) SetWithDurationContext(ctx context.Context, name string, value string, d time.Duration) error {
+	args := m.Called(ctx, name, value, d)
+	return args.Error(0)
+}
+
+func (m *MockRedis) DeleteContext(ctx context.Context, names ...string) error {
+	args := m.Called(ctx, names)
+	return args.Error(0)
+}
+
+func (m *MockRedis) ExistsContext(ctx context.Context, name string) (bool, error) {
+	args := m.Called(ctx, name)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRedis) KeysContext(ctx context.Context, pattern string) ([]string, error) {
+	args := m.Called(ctx, pattern)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+// RedisContext is Redis with the request context passed through, so cancellation, deadlines and tracing reach redis
+type RedisContext interface {
+	PingContext(ctx context.Context) error
+	GetContext(ctx context.Context, name string) (string, error)
+	// SetContext store value for the default expiry of the client
+	SetContext(ctx context.Context, name string, value string) error
+	// SetWithDurationContext store value for d, 0 means no expiry
+	SetWithDurationContext(ctx context.Context, name string, value string, d time.Duration) error
+	DeleteContext(ctx context.Context, names ...string) error
+	ExistsContext(ctx context.Context, name string) (bool, error)
+	// KeysContext return the keys matching pattern, every key when pattern is empty. keys are returned as stored, with the prefix
+	KeysContext(ctx context.Context, pattern string) ([]string, error)
+}
+
+// Redis methods without context are adapters of the RedisContext ones running with context.Background()
 type Redis interface {
+	RedisContext
 	Ping() error
 	Get(name string) (string, error)
 	Set(name string, value string) error
@@ -95,42 +147,96 @@ type rds struct {
 	prefix   string
 }
 
-func (c *rds) PrintKeys() {
-	var cursor uint64
-	for {
-		var keys []string
-		var err error
-		keys, cursor, err = c.rdb.Scan(context.Background(), cursor, "", 0).Result()
-		if err != nil {
-			panic(err)
-		}
+func (c *rds) key(name string) string {
+	return c.prefix + "_" + name
+}
 
-		for _, key := range keys {
-			fmt.Println("key", key)
-		}
+func (c *rds) PrintKeys() {
+	keys, err := c.KeysContext(context.Background(), "")
+	if err != nil {
+		panic(err)
+	}
 
-		if cursor == 0 { // no more keys
-			break
-		}
+	for _, key := range keys {
+		fmt.Println("key", key)
 	}
 }
 
 func (c *rds) SetWithDuration(name string, value string, d time.Duration) error {
-	return c.rdb.Set(context.Background(), c.prefix+"_"+name, value, d).Err()
+	return c.SetWithDurationContext(context.Background(), name, value, d)
 }
 
 func (c *rds) Set(name string, value string) error {
-	return c.rdb.Set(context.Background(), c.prefix+"_"+name, value, c.expiracy).Err()
+	return c.SetContext(context.Background(), name, value)
 }
 
 func (c *rds) Get(name string) (string, error) {
-	return c.rdb.Get(context.Background(), c.prefix+"_"+name).Result()
+	return c.GetContext(context.Background(), name)
 }
 
 func (c *rds) Delete(name string) error {
-	return c.rdb.Del(context.Background(), c.prefix+"_"+name).Err()
+	return c.DeleteContext(context.Background(), name)
 }
 
 func (c *rds) Ping() error {
-	return c.rdb.Ping(context.Background()).Err()
+	return c.PingContext(context.Background())
+}
+
+func (c *rds) PingContext(ctx context.Context) error {
+	return c.rdb.Ping(ctx).Err()
+}
+
+func (c *rds) GetContext(ctx context.Context, name string) (string, error) {
+	return c.rdb.Get(ctx, c.key(name)).Result()
+}
+
+func (c *rds) SetContext(ctx context.Context, name string, value string) error {
+	return c.rdb.Set(ctx, c.key(name), value, c.expiracy).Err()
+}
+
+func (c *rds) SetWithDurationContext(ctx context.Context, name string, value string, d time.Duration) error {
+	return c.rdb.Set(ctx, c.key(name), value, d).Err()
+}
+
+func (c *rds) DeleteContext(ctx context.Context, names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = c.key(name)
+	}
+	return c.rdb.Del(ctx, keys...).Err()
+}
+
+func (c *rds) ExistsContext(ctx context.Context, name string) (bool, error) {
+	n, err := c.rdb.Exists(ctx, c.key(name)).Result()
+	return n > 0, err
+}
+
+func (c *rds) KeysContext(ctx context.Context, pattern string) ([]string, error) {
+	if pattern != "" {
+		pattern = c.key(pattern)
+	}
+
+	var all []string
+	var cursor uint64
+	for {
+		keys, next, err := c.rdb.Scan(ctx, cursor, pattern, 0).Result()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, keys...)
+
+		cursor = next
+		if cursor == 0 { // no more keys
+			return all, nil
+		}
+	}
+}
+
+// isRedisNil report whether err is the miss error returned by Get
+func isRedisNil(err error) bool {
+	return errors.Is(err, redis.Nil)
 }
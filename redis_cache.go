@@ -0,0 +1,167 @@
+package utilities
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// ErrCacheMiss is returned by GetJSON and GetCached when the key is not in redis
+var ErrCacheMiss = errors.New("cache miss")
+
+// CacheCodec turn cached values into the bytes stored in redis and back
+type CacheCodec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// JSONCodec store values as json, readable from redis-cli and other languages
+	JSONCodec CacheCodec = jsonCodec{}
+	// MsgpackCodec store values as msgpack, smaller and faster than json. fields use the codec or json tag
+	MsgpackCodec CacheCodec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+var msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var out []byte
+	err := codec.NewEncoderBytes(&out, msgpackHandle).Encode(v)
+	return out, err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
+
+const (
+	gzipRaw        byte = 0
+	gzipCompressed byte = 1
+)
+
+/*
+GzipCodec compress the output of inner when it is at least minSize bytes, smaller values are stored as is.
+a one byte header tells both apart, so minSize can change without breaking cached values
+
+	codec := GzipCodec(JSONCodec, 1024)
+	err := SetCached(ctx, rds, codec, "report_2024", report, time.Hour)
+*/
+func GzipCodec(inner CacheCodec, minSize int) CacheCodec {
+	return gzipCodec{inner: inner, minSize: minSize}
+}
+
+type gzipCodec struct {
+	inner   CacheCodec
+	minSize int
+}
+
+func (c gzipCodec) Marshal(v any) ([]byte, error) {
+	data, err := c.inner.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < c.minSize {
+		return append([]byte{gzipRaw}, data...), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(gzipCompressed)
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Unmarshal(data []byte, v any) error {
+	if len(data) == 0 {
+		return fmt.Errorf("empty gzip cache value")
+	}
+
+	switch data[0] {
+	case gzipRaw:
+		return c.inner.Unmarshal(data[1:], v)
+	case gzipCompressed:
+		zr, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		plain, err := io.ReadAll(zr)
+		if err != nil {
+			return err
+		}
+		return c.inner.Unmarshal(plain, v)
+	default:
+		return fmt.Errorf("unknown gzip cache header %d", data[0])
+	}
+}
+
+/*
+GetJSON read a json value stored by SetJSON, a missing key is ErrCacheMiss
+
+	user, err := GetJSON[User](ctx, rds, "user_"+id)
+	if errors.Is(err, ErrCacheMiss) {
+		//load from the database
+	}
+*/
+func GetJSON[T any](ctx context.Context, r RedisContext, key string) (T, error) {
+	return GetCached[T](ctx, r, JSONCodec, key)
+}
+
+// SetJSON store v as json for ttl, 0 means no expiry
+func SetJSON(ctx context.Context, r RedisContext, key string, v any, ttl time.Duration) error {
+	return SetCached(ctx, r, JSONCodec, key, v, ttl)
+}
+
+// GetCached read a value stored with codec, a missing key is ErrCacheMiss
+func GetCached[T any](ctx context.Context, r RedisContext, c CacheCodec, key string) (T, error) {
+	var v T
+	raw, err := r.GetContext(ctx, key)
+	if err != nil {
+		if isRedisNil(err) {
+			return v, ErrCacheMiss
+		}
+		return v, fmt.Errorf("failed to get cache %s: %w", key, err)
+	}
+
+	if err := c.Unmarshal([]byte(raw), &v); err != nil {
+		return v, fmt.Errorf("failed to decode cache %s: %w", key, err)
+	}
+	return v, nil
+}
+
+// SetCached store v encoded with codec for ttl, 0 means no expiry
+func SetCached(ctx context.Context, r RedisContext, c CacheCodec, key string, v any, ttl time.Duration) error {
+	data, err := c.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache %s: %w", key, err)
+	}
+	if err := r.SetWithDurationContext(ctx, key, string(data), ttl); err != nil {
+		return fmt.Errorf("failed to set cache %s: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package utilities
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ Redis        = (*MockRedis)(nil)
+	_ RedisContext = (*MockRedis)(nil)
+)
+
+func TestNewRedisIsRedisContext(t *testing.T) {
+	var r RedisContext = NewRedis(NewRedisClient("127.0.0.1", "0", "", 0), "app", 60)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, r.PingContext(ctx), context.Canceled)
+}
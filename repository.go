@@ -0,0 +1,313 @@
+package utilities
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/stretchr/testify/mock"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type MockRepository[T any] struct {
+	mock.Mock
+}
+
+func (m *MockRepository[T]) Find(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) ([]T, error) {
+	args := m.Called(ctx, scopes)
+	return args.Get(0).([]T), args.Error(1)
+}
+
+func (m *MockRepository[T]) FindByID(ctx context.Context, id any) (*T, error) {
+	args := m.Called(ctx, id)
+	if v := args.Get(0); v != nil {
+		return v.(*T), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockRepository[T]) First(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (*T, error) {
+	args := m.Called(ctx, scopes)
+	if v := args.Get(0); v != nil {
+		return v.(*T), args.Error(1)
+	}
+	return nil, args.Error(1)
+}
+
+func (m *MockRepository[T]) Page(ctx context.Context, page, limit int, sort, order *string, scopes ...func(*gorm.DB) *gorm.DB) (ListResult[T], error) {
+	args := m.Called(ctx, page, limit, sort, order, scopes)
+	return args.Get(0).(ListResult[T]), args.Error(1)
+}
+
+func (m *MockRepository[T]) List(ctx context.Context, q ListQuery) (ListResult[T], error) {
+	args := m.Called(ctx, q)
+	return args.Get(0).(ListResult[T]), args.Error(1)
+}
+
+func (m *MockRepository[T]) Count(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (int64, error) {
+	args := m.Called(ctx, scopes)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockRepository[T]) Exists(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (bool, error) {
+	args := m.Called(ctx, scopes)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRepository[T]) ExistsByID(ctx context.Context, id any) (bool, error) {
+	args := m.Called(ctx, id)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockRepository[T]) Create(ctx context.Context, record *T) error {
+	args := m.Called(ctx, record)
+	return args.Error(0)
+}
+
+func (m *MockRepository[T]) Update(ctx context.Context, record *T) error {
+	args := m.Called(ctx, record)
+	return args.Error(0)
+}
+
+func (m *MockRepository[T]) UpdateFields(ctx context.Context, id any, values any) error {
+	args := m.Called(ctx, id, values)
+	return args.Error(0)
+}
+
+func (m *MockRepository[T]) Delete(ctx context.Context, id any) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+/*
+Repository is the CRUD of one model over the tenant database of the context.
+Errors wrap ErrNotFound and ErrConflict (unique and foreign key violations) so handlers can map them
+with errors.Is, the driver error stays in the chain.
+
+	users := NewRepository[User](dbm)
+	user, err := users.FindByID(ctx, id)
+	if errors.Is(err, ErrNotFound) {
+		c.JSON(http.StatusNotFound, ...)
+	}
+*/
+type Repository[T any] interface {
+	Find(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) ([]T, error)
+	FindByID(ctx context.Context, id any) (*T, error)
+	First(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (*T, error)
+	// Page return one page using Paging and Sorting
+	Page(ctx context.Context, page, limit int, sort, order *string, scopes ...func(*gorm.DB) *gorm.DB) (ListResult[T], error)
+	// List return one page of a ParseListQuery query, see FindList
+	List(ctx context.Context, q ListQuery) (ListResult[T], error)
+	Count(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (int64, error)
+	Exists(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (bool, error)
+	ExistsByID(ctx context.Context, id any) (bool, error)
+	Create(ctx context.Context, record *T) error
+	// Update write every column of record, the record is matched on its primary key
+	Update(ctx context.Context, record *T) error
+	// UpdateFields write the entries of a map[string]any or the non zero fields of a *T to the record with primary key id
+	UpdateFields(ctx context.Context, id any, values any) error
+	Delete(ctx context.Context, id any) error
+}
+
+func NewRepository[T any](dbm DBManager) Repository[T] {
+	return &repository[T]{dbm: dbm}
+}
+
+type repository[T any] struct {
+	dbm DBManager
+}
+
+func (r *repository[T]) db(ctx context.Context) (*gorm.DB, error) {
+	db, err := r.dbm.DB(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return db.Model(new(T)), nil
+}
+
+func byID(id any) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(clause.Eq{Column: clause.PrimaryColumn, Value: id})
+	}
+}
+
+func (r *repository[T]) Find(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) ([]T, error) {
+	db, err := r.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []T{}
+	if err := db.Scopes(scopes...).Find(&items).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	return items, nil
+}
+
+func (r *repository[T]) FindByID(ctx context.Context, id any) (*T, error) {
+	return r.First(ctx, byID(id))
+}
+
+func (r *repository[T]) First(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (*T, error) {
+	db, err := r.db(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	record := new(T)
+	if err := db.Scopes(scopes...).First(record).Error; err != nil {
+		return nil, mapDBError(err)
+	}
+	return record, nil
+}
+
+func (r *repository[T]) Page(ctx context.Context, page, limit int, sort, order *string, scopes ...func(*gorm.DB) *gorm.DB) (ListResult[T], error) {
+	result := ListResult[T]{Items: []T{}}
+	db, err := r.db(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	page, limit = normalizePaging(page, limit)
+	base := db.Scopes(scopes...).Session(&gorm.Session{})
+
+	var total int64
+	if err := base.Count(&total).Error; err != nil {
+		return result, fmt.Errorf("failed to count: %w", mapDBError(err))
+	}
+	if err := base.Scopes(Sorting(sort, order), Paging(page, limit)).Find(&result.Items).Error; err != nil {
+		return result, fmt.Errorf("failed to find: %w", mapDBError(err))
+	}
+
+	pages := int(math.Ceil(float64(total) / float64(limit)))
+	result.Meta = ListMeta{
+		Page:    page,
+		Limit:   limit,
+		Total:   total,
+		Pages:   pages,
+		HasNext: page < pages,
+	}
+	return result, nil
+}
+
+func (r *repository[T]) List(ctx context.Context, q ListQuery) (ListResult[T], error) {
+	db, err := r.dbm.DB(ctx)
+	if err != nil {
+		return ListResult[T]{Items: []T{}}, err
+	}
+	return FindList[T](db, q)
+}
+
+func (r *repository[T]) Count(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (int64, error) {
+	db, err := r.db(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	if err := db.Scopes(scopes...).Count(&total).Error; err != nil {
+		return 0, mapDBError(err)
+	}
+	return total, nil
+}
+
+func (r *repository[T]) Exists(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (bool, error) {
+	db, err := r.db(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var found []int
+	if err := db.Scopes(scopes...).Select("1").Limit(1).Find(&found).Error; err != nil {
+		return false, mapDBError(err)
+	}
+	return len(found) > 0, nil
+}
+
+func (r *repository[T]) ExistsByID(ctx context.Context, id any) (bool, error) {
+	return r.Exists(ctx, byID(id))
+}
+
+func (r *repository[T]) Create(ctx context.Context, record *T) error {
+	db, err := r.dbm.DB(ctx)
+	if err != nil {
+		return err
+	}
+	return mapDBError(db.Create(record).Error)
+}
+
+func (r *repository[T]) Update(ctx context.Context, record *T) error {
+	db, err := r.dbm.DB(ctx)
+	if err != nil {
+		return err
+	}
+
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(record); err != nil {
+		return fmt.Errorf("failed to parse model: %w", err)
+	}
+
+	res := db.Model(record).Select("*").Omit(autoCreateColumns(stmt.Schema)...).Updates(record)
+	return r.checkWrite(res, func() (bool, error) {
+		pk := stmt.Schema.PrioritizedPrimaryField
+		if pk == nil {
+			return true, nil
+		}
+		id, _ := pk.ValueOf(ctx, reflect.ValueOf(record).Elem())
+		return r.ExistsByID(ForcePrimary(ctx), id)
+	})
+}
+
+func (r *repository[T]) UpdateFields(ctx context.Context, id any, values any) error {
+	switch values.(type) {
+	case map[string]any, *T:
+	default:
+		return fmt.Errorf("update values must be a map[string]any or *%T", *new(T))
+	}
+
+	db, err := r.db(ctx)
+	if err != nil {
+		return err
+	}
+
+	res := db.Scopes(byID(id)).Updates(values)
+	return r.checkWrite(res, func() (bool, error) { return r.ExistsByID(ForcePrimary(ctx), id) })
+}
+
+func (r *repository[T]) Delete(ctx context.Context, id any) error {
+	db, err := r.dbm.DB(ctx)
+	if err != nil {
+		return err
+	}
+
+	res := db.Scopes(byID(id)).Delete(new(T))
+	if res.Error != nil {
+		return mapDBError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkWrite map the error of an update and report ErrNotFound when no row matched.
+// mysql reports unchanged rows as not affected, so the record is looked up before calling it missing
+func (r *repository[T]) checkWrite(res *gorm.DB, exists func() (bool, error)) error {
+	if res.Error != nil {
+		return mapDBError(res.Error)
+	}
+	if res.RowsAffected > 0 {
+		return nil
+	}
+
+	found, err := exists()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package utilities
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+var (
+	// ErrMissingTenant is returned when a tenant scoped model is used with a context without tenant
+	ErrMissingTenant = errors.New("missing tenant in context")
+	// ErrTenantMismatch is returned when a record is written with the tenant of another tenant
+	ErrTenantMismatch = errors.New("record belongs to another tenant")
+)
+
+type tenantIDKey struct{}
+type tenantUnscopedKey struct{}
+
+// WithTenantID set the tenant used by the tenant scope plugin for queries made with ctx
+func WithTenantID(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantIDKey{}, tenantID)
+}
+
+func TenantID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(tenantIDKey{}).(string)
+	return id
+}
+
+// TenantUnscoped disable the tenant filter for queries made with ctx, meant for admin and maintenance jobs only.
+// It is unrelated to gorm Unscoped, which only disables soft delete
+func TenantUnscoped(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantUnscopedKey{}, true)
+}
+
+func isTenantUnscoped(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	unscoped, _ := ctx.Value(tenantUnscopedKey{}).(bool)
+	return unscoped
+}
+
+/*
+NewTenantScopePlugin scope models of shared tables to the tenant of the context.
+The tenant column of a model is the field tagged tenant:"true", queries, updates and deletes (soft deletes included)
+get a WHERE on that column, creates and updates get it filled in and upserts (ON CONFLICT) never change a row
+of another tenant. A scoped model used without tenant in the context fails
+instead of reading or writing every tenant, use TenantUnscoped to go across tenants on purpose.
+Raw SQL (Raw, Exec) is not rewritten.
+
+	type Invoice struct {
+		ID        uint
+		TenantID  string `gorm:"size:64;index" tenant:"true"`
+		Amount    int64
+		DeletedAt gorm.DeletedAt
+	}
+
+	dbm := NewDBManager(cfg, WithGormPlugins(NewTenantScopePlugin()))
+	db, _ := dbm.DB(WithTenantID(ctx, tenantID))
+*/
+func NewTenantScopePlugin() gorm.Plugin {
+	return &tenantScopePlugin{}
+}
+
+type tenantScopePlugin struct{}
+
+func (p *tenantScopePlugin) Name() string {
+	return "utilities:tenant_scope"
+}
+
+// Initialize register the callbacks first in their chain so later callbacks like the audit capture see the filter
+func (p *tenantScopePlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	if err := cb.Create().Before("*").Register("utilities:tenant_create", p.assign); err != nil {
+		return err
+	}
+	if err := cb.Query().Before("*").Register("utilities:tenant_query", p.filter); err != nil {
+		return err
+	}
+	if err := cb.Row().Before("*").Register("utilities:tenant_row", p.filter); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("*").Register("utilities:tenant_update", p.filterUpdate); err != nil {
+		return err
+	}
+	if err := cb.Delete().Before("*").Register("utilities:tenant_delete", p.filterDelete); err != nil {
+		return err
+	}
+
+	//upserts are constrained when the clause is built, GORM expands OnConflict{UpdateAll: true} inside gorm:create
+	builder := db.ClauseBuilders["ON CONFLICT"]
+	db.ClauseBuilders["ON CONFLICT"] = func(c clause.Clause, b clause.Builder) {
+		p.buildOnConflict(c, b, builder)
+	}
+	return nil
+}
+
+// tenant return the tenant field of the statement model and the tenant of the context,
+// ok is false when the statement is not tenant scoped
+func (p *tenantScopePlugin) tenant(db *gorm.DB) (field *schema.Field, tenantID string, ok bool) {
+	stmt := db.Statement
+	if db.Error != nil || stmt.Schema == nil || stmt.SQL.Len() > 0 {
+		return nil, "", false
+	}
+
+	field = tenantField(stmt.Schema)
+	if field == nil || isTenantUnscoped(stmt.Context) {
+		return nil, "", false
+	}
+
+	tenantID = TenantID(stmt.Context)
+	if tenantID == "" {
+		db.AddError(fmt.Errorf("%s: %w", stmt.Schema.Table, ErrMissingTenant))
+		return nil, "", false
+	}
+	return field, tenantID, true
+}
+
+func (p *tenantScopePlugin) filter(db *gorm.DB) {
+	field, tenantID, ok := p.tenant(db)
+	if !ok {
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: tenantID},
+	}})
+}
+
+// filterWrite also refuse writes on records of another tenant. The tenant filter would satisfy the GORM check
+// for a WHERE clause on updates and deletes, so that check is done here first. ok is false when nothing was scoped
+func (p *tenantScopePlugin) filterWrite(db *gorm.DB) bool {
+	field, tenantID, ok := p.tenant(db)
+	if !ok {
+		return false
+	}
+	if !db.AllowGlobalUpdate && !hasWriteConditions(db) {
+		db.AddError(gorm.ErrMissingWhereClause)
+		return false
+	}
+	for _, dest := range []any{db.Statement.Model, db.Statement.Dest} {
+		if err := checkTenantValue(db, field, tenantID, dest); err != nil {
+			db.AddError(err)
+			return false
+		}
+	}
+	p.filter(db)
+	return true
+}
+
+func (p *tenantScopePlugin) filterDelete(db *gorm.DB) {
+	p.filterWrite(db)
+}
+
+// filterUpdate fill the tenant of the update values, so Save and Select("*") never write an empty tenant
+func (p *tenantScopePlugin) filterUpdate(db *gorm.DB) {
+	if !p.filterWrite(db) {
+		return
+	}
+	field, tenantID, _ := p.tenant(db)
+	setTenantValue(db, field, tenantID, db.Statement.Dest, true)
+}
+
+func (p *tenantScopePlugin) assign(db *gorm.DB) {
+	field, tenantID, ok := p.tenant(db)
+	if !ok {
+		return
+	}
+	if err := checkTenantValue(db, field, tenantID, db.Statement.Dest); err != nil {
+		db.AddError(err)
+		return
+	}
+	setTenantValue(db, field, tenantID, db.Statement.Dest, false)
+}
+
+/*
+buildOnConflict keep upserts of scoped models inside the tenant, a conflicting row of another tenant is left untouched.
+postgres gets a WHERE on the DO UPDATE, mysql has no WHERE on ON DUPLICATE KEY UPDATE so every assignment keeps
+the current value when the tenants differ :
+
+	ON CONFLICT ("id") DO UPDATE SET "amount"="excluded"."amount" WHERE "invoices"."tenant_id" = "excluded"."tenant_id"
+	ON DUPLICATE KEY UPDATE `amount`=IF(`tenant_id` = VALUES(`tenant_id`), VALUES(`amount`), `amount`)
+*/
+func (p *tenantScopePlugin) buildOnConflict(c clause.Clause, b clause.Builder, next clause.ClauseBuilder) {
+	onConflict, ok := c.Expression.(clause.OnConflict)
+	stmt, isStmt := b.(*gorm.Statement)
+	if ok && isStmt && !onConflict.DoNothing && stmt.Schema != nil && !isTenantUnscoped(stmt.Context) {
+		if field := tenantField(stmt.Schema); field != nil {
+			tenant := clause.Column{Name: field.DBName}
+			if stmt.Dialector.Name() == "mysql" {
+				updates := make(clause.Set, 0, len(onConflict.DoUpdates))
+				for _, a := range onConflict.DoUpdates {
+					if a.Column.Name == field.DBName {
+						continue
+					}
+					value := a.Value
+					if col, ok := value.(clause.Column); ok && col.Table == "excluded" {
+						value = clause.Expr{SQL: "VALUES(?)", Vars: []any{clause.Column{Name: col.Name}}}
+					}
+					updates = append(updates, clause.Assignment{Column: a.Column, Value: clause.Expr{
+						SQL:  "IF(? = VALUES(?), ?, ?)",
+						Vars: []any{tenant, tenant, value, clause.Column{Name: a.Column.Name}},
+					}})
+				}
+				onConflict.DoUpdates = updates
+				//no assignment left, keep the row as is instead of letting the driver pick one
+				if len(updates) == 0 {
+					onConflict.DoNothing = true
+				}
+			} else {
+				onConflict.Where.Exprs = append(onConflict.Where.Exprs, clause.Eq{
+					Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName},
+					Value:  clause.Column{Table: "excluded", Name: field.DBName},
+				})
+			}
+			c.Expression = onConflict
+		}
+	}
+
+	if next != nil {
+		next(c, b)
+		return
+	}
+	c.Build(b)
+}
+
+// setTenantValue write tenantID into dest, with onlyPresent maps only get it when they already hold the tenant key
+func setTenantValue(db *gorm.DB, field *schema.Field, tenantID string, dest any, onlyPresent bool) {
+	setMap := func(m map[string]any) {
+		_, byColumn := m[field.DBName]
+		_, byName := m[field.Name]
+		if onlyPresent && !byColumn && !byName {
+			return
+		}
+		delete(m, field.Name)
+		m[field.DBName] = tenantID
+	}
+
+	stmt := db.Statement
+	switch d := dest.(type) {
+	case map[string]any:
+		setMap(d)
+	case *map[string]any:
+		setMap(*d)
+	case []map[string]any:
+		for _, row := range d {
+			setMap(row)
+		}
+	default:
+		rv := reflect.ValueOf(dest)
+		for rv.Kind() == reflect.Ptr {
+			rv = rv.Elem()
+		}
+		if !rv.IsValid() || (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array && rv.Type() != stmt.Schema.ModelType) {
+			return
+		}
+		eachRecord(rv, func(rv reflect.Value) {
+			if rv.Type() != stmt.Schema.ModelType || !rv.CanAddr() {
+				return
+			}
+			if err := field.Set(stmt.Context, rv, tenantID); err != nil {
+				db.AddError(fmt.Errorf("failed to set tenant: %w", err))
+			}
+		})
+	}
+}
+
+// checkTenantValue fail when dest carries a tenant different from tenantID, zero values are allowed
+func checkTenantValue(db *gorm.DB, field *schema.Field, tenantID string, dest any) error {
+	stmt := db.Statement
+	var values []any
+	switch d := dest.(type) {
+	case map[string]any:
+		values = append(values, d[field.DBName], d[field.Name])
+	case *map[string]any:
+		values = append(values, (*d)[field.DBName], (*d)[field.Name])
+	case []map[string]any:
+		for _, row := range d {
+			values = append(values, row[field.DBName], row[field.Name])
+		}
+	default:
+		rv := reflect.ValueOf(dest)
+		for rv.Kind() == reflect.Ptr {
+			rv = rv.Elem()
+		}
+		if rv.IsValid() && (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array || rv.Type() == stmt.Schema.ModelType) {
+			eachRecord(rv, func(rv reflect.Value) {
+				if v, zero := field.ValueOf(stmt.Context, rv); !zero {
+					values = append(values, v)
+				}
+			})
+		}
+	}
+
+	for _, v := range values {
+		rv := reflect.ValueOf(v)
+		if !rv.IsValid() || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+			continue
+		}
+		if s := fmt.Sprint(reflect.Indirect(rv)); s != "" && s != tenantID {
+			return fmt.Errorf("%s: %w", stmt.Schema.Table, ErrTenantMismatch)
+		}
+	}
+	return nil
+}
+
+// hasWriteConditions report whether the statement has a WHERE clause or a model with a primary key,
+// it runs before GORM points ReflectValue at the model so the model is read directly
+func hasWriteConditions(db *gorm.DB) bool {
+	stmt := db.Statement
+	if _, ok := stmt.Clauses["WHERE"]; ok {
+		return true
+	}
+
+	pk := stmt.Schema.PrioritizedPrimaryField
+	if pk == nil {
+		return false
+	}
+	found := false
+	eachRecord(reflect.ValueOf(stmt.Model), func(rv reflect.Value) {
+		if _, zero := pk.ValueOf(stmt.Context, rv); !zero {
+			found = true
+		}
+	})
+	return found
+}
+
+func tenantField(sch *schema.Schema) *schema.Field {
+	for _, f := range sch.Fields {
+		if f.DBName != "" && f.Tag.Get("tenant") == "true" {
+			return f
+		}
+	}
+	return nil
+}
@@ -34,6 +34,18 @@ func EnvArray(envName string) []string {
 	ar := strings.Split(val, ",")
 	return ar
 }
+
+// envList is EnvArray without empty entries, so an unset variable gives an empty list
+func envList(envName string) []string {
+	var list []string
+	for _, v := range EnvArray(envName) {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func EnvInt(envName string) int {
 	val, _ := strconv.Atoi(os.Getenv(envName))
 	return val